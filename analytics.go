@@ -1,16 +1,31 @@
 package analytics
 
 import (
+	"context"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"io/ioutil"
 	"os"
+	"reflect"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 
 	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"log"
+	"net"
 	"net/http"
+	"syscall"
 	"time"
 
 	"github.com/jehiah/go-strftime"
@@ -24,24 +39,217 @@ const Version = "2.1.0"
 // Endpoint for the Segment API.
 const Endpoint = "https://api.segment.io"
 
+// EndpointEU is the endpoint of the Segment API in the EU region.
+const EndpointEU = "https://events.eu1.segmentapis.com"
+
+// Region of the Segment API, selecting its default endpoint.
+type Region string
+
+// Regions of the Segment API.
+const (
+	RegionUS Region = "us"
+	RegionEU Region = "eu"
+)
+
+// Endpoints of the regions.
+var regionEndpoints = map[Region]string{
+	RegionUS: Endpoint,
+	RegionEU: EndpointEU,
+}
+
+// Maximum size of a batch accepted by the API.
+const maxBatchBytes = 500 * 1024
+
+// Maximum size of the response bodies in verbose logs.
+const maxLoggedBody = 1024
+
+// Library set in the context of messages.
+var library = map[string]interface{}{
+	"name":    "analytics-go",
+	"version": Version,
+}
+
 // DefaultContext of message batches.
 var DefaultContext = map[string]interface{}{
-	"library": map[string]interface{}{
-		"name":    "analytics-go",
-		"version": Version,
-	},
+	"library": library,
+}
+
+// Backoff policy, used unless Client.RetryAfter is set. Delays are jittered
+// so that clients recovering from a shared outage don't retry in lockstep.
+var Backo = backo.NewBacko(100*time.Millisecond, 2, 0.25, 10*time.Second)
+
+// NewBackoffPolicy returns a backoff for Client.RetryAfter, doubling from base
+// up to max with every attempt. Each delay is randomly varied by up to the
+// jitter fraction of itself.
+func NewBackoffPolicy(base, max time.Duration, jitter float64) func(attempt int) time.Duration {
+	return backo.NewBacko(base, 2, jitter, max).Duration
+}
+
+// ErrClosed is returned when using a client after it was closed.
+var ErrClosed = errors.New("client is closed")
+
+// ErrQueueFull is returned when a message is rejected by the DropNewest
+// overflow policy.
+var ErrQueueFull = errors.New("message queue is full")
+
+// ErrDropped is wrapped by the errors of EnqueueAwait for messages that were
+// intentionally dropped, such as sampled out or duplicate ones. Those of the
+// messages dropped from a full queue also wrap ErrQueueFull.
+var ErrDropped = errors.New("message dropped")
+
+// APIError is the error of an upload rejected by the API, as reported to
+// Callback.Failure.
+type APIError struct {
+	StatusCode int
+	Body       string
+	// Retryable tells whether the upload is retried, which by default it is
+	// not for client errors other than rate limiting, see ShouldRetry.
+	Retryable bool
+	// RetryAfter is the delay requested by the Retry-After header, if any.
+	// It takes precedence over shorter delays of the backoff policy.
+	RetryAfter time.Duration
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("response %d %s: %d – %s", e.StatusCode, http.StatusText(e.StatusCode), e.StatusCode, e.Body)
+}
+
+// FieldError is returned for a message rejected because of the value of one
+// of its fields. Value is nil for missing fields.
+type FieldError struct {
+	Field  string
+	Value  interface{}
+	Reason string
+}
+
+func (e *FieldError) Error() string {
+	if e.Value == nil {
+		return e.Reason
+	}
+	return fmt.Sprintf("invalid '%s' %v: %s", e.Field, e.Value, e.Reason)
+}
+
+// As makes a FieldError a *ValidationError for errors.As.
+func (e *FieldError) As(target interface{}) bool {
+	if t, ok := target.(**ValidationError); ok {
+		*t = &ValidationError{Err: e}
+		return true
+	}
+	return false
+}
+
+// ValidationError is the class of errors of invalid messages, for errors.As:
+// messages rejected because of their fields are reported with a *FieldError,
+// which is also a *ValidationError. Every message rejected before it is
+// queued is reported with one of the two.
+type ValidationError struct {
+	Err error
+}
+
+func (e *ValidationError) Error() string {
+	return e.Err.Error()
 }
 
-// Backoff policy.
-var Backo = backo.DefaultBacko()
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// ConfigError is the error of a client configured in a way that can't work,
+// such as with an empty write key, returned by Start and every Enqueue.
+type ConfigError struct {
+	Err error
+}
+
+func (e *ConfigError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// SendError is the error of an upload that got no response from the API,
+// such as a network failure, as reported to Callback.Failure. Uploads
+// rejected by the API are reported with an *APIError.
+type SendError struct {
+	Endpoint string
+	Err      error
+}
+
+func (e *SendError) Error() string {
+	return fmt.Sprintf("error uploading to %s: %s", e.Endpoint, e.Err)
+}
+
+func (e *SendError) Unwrap() error {
+	return e.Err
+}
+
+// RetryExhaustedError is the error of an upload given up on after MaxRetries
+// retries, as reported to Callback.Failure. Err is the error of the last
+// attempt, an *APIError or a *SendError.
+type RetryExhaustedError struct {
+	Attempts int
+	Err      error
+}
+
+func (e *RetryExhaustedError) Error() string {
+	return fmt.Sprintf("giving up after %d attempts: %s", e.Attempts, e.Err)
+}
+
+func (e *RetryExhaustedError) Unwrap() error {
+	return e.Err
+}
+
+// OverflowPolicy decides what happens to messages enqueued while the queue
+// is full.
+type OverflowPolicy int
+
+const (
+	// BlockOnFull blocks until there is room in the queue.
+	BlockOnFull OverflowPolicy = iota
+	// DropNewest rejects the message with ErrQueueFull.
+	DropNewest
+	// DropOldest evicts the oldest queued message of the lowest priority to
+	// make room, rejecting the message with ErrQueueFull when only messages
+	// of a higher priority are queued.
+	DropOldest
+)
+
+// Priority of a message, see EnqueuePriority.
+type Priority int
+
+const (
+	// PriorityNormal is the priority of the messages enqueued by Enqueue.
+	PriorityNormal Priority = iota
+	// PriorityHigh messages are queued ahead of the others, and batched
+	// separately so that their batches are sent first. With DropOldest, they
+	// evict the normal messages before the other high priority ones.
+	PriorityHigh
+	// PriorityLow messages are dropped rather than queued while the queue is
+	// full, whatever the OverflowPolicy, and are the first evicted to make
+	// room for the others, so that they go first under load.
+	PriorityLow
+)
 
 // Message interface.
 type message interface {
 	setMessageId(string)
 	setTimestamp(string)
+	typ() string
+	id() string
+	eventTime() string
+	contextMap() *map[string]interface{}
+	integrationsMap() *map[string]interface{}
+	propertiesMap() *map[string]interface{}
+	validate() error
 }
 
-// Message fields common to all.
+// Message fields common to all. Timestamp is the time of the event and
+// SentAt the time it was uploaded. The client sets the MessageId and
+// Timestamp of enqueued messages unless they are already set, the Timestamp
+// to the time it was enqueued, or to the SentAt of its batch without
+// FreezeTimestampAtEnqueue. It never sets their SentAt, which is set on the
+// batch when it is uploaded.
 type Message struct {
 	Type      string `json:"type,omitempty"`
 	MessageId string `json:"messageId,omitempty"`
@@ -49,7 +257,7 @@ type Message struct {
 	SentAt    string `json:"sentAt,omitempty"`
 }
 
-// Batch message.
+// Batch message, as uploaded by the client or built for SendBatch.
 type Batch struct {
 	Context  map[string]interface{} `json:"context,omitempty"`
 	Messages []interface{}          `json:"batch"`
@@ -100,33 +308,589 @@ type Page struct {
 	Message
 }
 
+// Screen message, the mobile counterpart of Page.
+type Screen struct {
+	Context      map[string]interface{} `json:"context,omitempty"`
+	Integrations map[string]interface{} `json:"integrations,omitempty"`
+	Properties   map[string]interface{} `json:"properties,omitempty"`
+	AnonymousId  string                 `json:"anonymousId,omitempty"`
+	UserId       string                 `json:"userId,omitempty"`
+	Category     string                 `json:"category,omitempty"`
+	Name         string                 `json:"name"`
+	Message
+}
+
 // Alias message.
 type Alias struct {
-	PreviousId string `json:"previousId"`
-	UserId     string `json:"userId"`
+	Context      map[string]interface{} `json:"context,omitempty"`
+	Integrations map[string]interface{} `json:"integrations,omitempty"`
+	PreviousId   string                 `json:"previousId"`
+	UserId       string                 `json:"userId"`
 	Message
 }
 
+// QueueWarningCallback may be implemented by a Callback to be warned when
+// the queue fills past the QueueWarnThreshold, before messages get dropped
+// or blocked by the OverflowPolicy.
+type QueueWarningCallback interface {
+	Callback
+	// QueueWarning is called with the number of queued messages and the
+	// MaxQueueSize, from the goroutine enqueueing the message.
+	QueueWarning(depth, capacity int)
+}
+
+// StructuredLogger logs messages with fields, e.g. as JSON. Level is "debug"
+// for the messages logged in Verbose mode, and "error" for the others.
+type StructuredLogger interface {
+	Log(level, msg string, fields map[string]interface{})
+}
+
+// PressureEvent is sent to Client.Pressure when the client comes under
+// pressure.
+type PressureEvent struct {
+	// QueueLength and QueueCapacity are those of the queue at the time.
+	QueueLength   int
+	QueueCapacity int
+	// Err is the error of the upload that failed for events of failing
+	// uploads, and nil for those of the queue filling up.
+	Err error
+}
+
+// Middleware transforms a message before it is validated and queued. It may
+// return a different message, or an error to drop it.
+type Middleware func(msg interface{}) (interface{}, error)
+
+// Callback is notified of the outcome of every message once its batch has
+// been uploaded or given up on. The methods are called once per message, in
+// the order of the messages within their batch, from the goroutine uploading
+// the batch; batches uploaded concurrently may be reported in any order.
+type Callback interface {
+	// Success is called for a message that was accepted by the server.
+	Success(msg interface{})
+	// Failure is called for a message whose batch could not be uploaded, with
+	// the error of the final attempt.
+	Failure(msg interface{}, err error)
+}
+
+// DropReason tells why a message was intentionally dropped.
+type DropReason int
+
+const (
+	// DropSampled is for messages discarded by the SampleRate.
+	DropSampled DropReason = iota
+	// DropQueueFull is for messages discarded by the OverflowPolicy.
+	DropQueueFull
+	// DropInvalid is for messages rejected by validation.
+	DropInvalid
+	// DropShutdown is for messages whose upload was aborted by the
+	// ShutdownTimeout.
+	DropShutdown
+	// DropFiltered is for track messages discarded by the AllowedEvents or
+	// BlockedEvents.
+	DropFiltered
+	// DropDuplicate is for messages discarded by Dedup.
+	DropDuplicate
+)
+
+func (r DropReason) String() string {
+	switch r {
+	case DropSampled:
+		return "sampled"
+	case DropQueueFull:
+		return "queue full"
+	case DropInvalid:
+		return "invalid"
+	case DropShutdown:
+		return "shutdown"
+	case DropFiltered:
+		return "filtered"
+	case DropDuplicate:
+		return "duplicate"
+	}
+	return fmt.Sprintf("DropReason(%d)", int(r))
+}
+
+// DropCallback may be implemented by a Callback to be told about every
+// message dropped by the client, whatever the DropReason. Dropped messages
+// are otherwise not reported, or reported as failures for DropShutdown.
+type DropCallback interface {
+	Callback
+	Drop(msg interface{}, reason DropReason)
+}
+
+// BatchCallback may be implemented by a Callback to be told about every
+// batch that was uploaded, before its messages are reported to Success.
+type BatchCallback interface {
+	Callback
+	// BatchSuccess is called with the number of messages of the batch, its
+	// serialized size before compression, and the time taken to upload it,
+	// retries included.
+	BatchSuccess(count int, bytes int, duration time.Duration)
+}
+
+// RetryCallback may be implemented by a Callback to be told about the
+// retries of uploads, e.g. to track how often batches only succeed once
+// retried.
+type RetryCallback interface {
+	Callback
+	// Retry is called before every retry of an upload, with its number
+	// counted from 1, and the error of the previous attempt.
+	Retry(attempt int, err error)
+	// SuccessAfter is called for every batch that was uploaded, with the
+	// number of attempts it took, before its messages are reported to
+	// Success.
+	SuccessAfter(attempts int)
+}
+
+// Stats of a client, see Client.Stats.
+type Stats struct {
+	// MessagesEnqueued counts the messages accepted by the client.
+	MessagesEnqueued int64
+	// QueueLength is the number of messages waiting to be uploaded, and
+	// MessagesInFlight the number of those being uploaded.
+	QueueLength      int64
+	MessagesInFlight int64
+	// MessagesSent and BatchesSent count successful uploads.
+	MessagesSent int64
+	BatchesSent  int64
+	// MessagesDropped counts the messages given up on after failed uploads,
+	// evicted from a full queue, or discarded as duplicates.
+	MessagesDropped int64
+	// RetriesTotal counts upload attempts made after a failure.
+	RetriesTotal int64
+	// UncompressedBytes and CompressedBytes add up the sizes of the gzip
+	// compressed batches uploaded successfully, before and after compression,
+	// giving the compression ratio achieved with Gzip.
+	UncompressedBytes int64
+	CompressedBytes   int64
+}
+
+// StreamTransport delivers batches over a persistent connection, such as a
+// WebSocket to a collector, see Client.StreamTransport. It must be safe for
+// concurrent use, and is expected to reconnect on its own.
+type StreamTransport interface {
+	// Send delivers a batch serialized with the Encoding of the client, and
+	// gzip compressed with Gzip, returning an error if it could not.
+	Send(ctx context.Context, batch io.Reader) error
+}
+
+// Store persists the messages queued by a client, see Client.Store. It must
+// be safe for concurrent use.
+type Store interface {
+	// Put persists a message serialized as JSON, returning its id.
+	Put(msg []byte) (id string, err error)
+	// Get returns up to n of the persisted messages, oldest first, skipping
+	// the ones returned by Put or Get since the store was opened unless they
+	// were released with Nack.
+	Get(n int) ([]StoredMessage, error)
+	// Ack deletes the messages that were uploaded or given up on.
+	Ack(ids ...string) error
+	// Nack releases the messages whose upload was aborted by the shutdown,
+	// to be returned by Get again.
+	Nack(ids ...string) error
+}
+
+// StoredMessage is a message returned by Store.Get.
+type StoredMessage struct {
+	Id   string
+	Data []byte
+}
+
+// Interface of the client, implemented by Client and by test doubles such as
+// analyticstest.Client.
+type Interface interface {
+	Alias(*Alias) error
+	Page(*Page) error
+	Screen(*Screen) error
+	Group(*Group) error
+	Identify(*Identify) error
+	Track(*Track) error
+	Enqueue(msg interface{}) error
+	EnqueueContext(ctx context.Context, msg interface{}) error
+	EnqueueAwait(msg interface{}) <-chan error
+	EnqueueBatch(msgs ...interface{}) error
+	Flush() error
+	FlushContext(ctx context.Context) error
+	Close() error
+}
+
+var _ Interface = (*Client)(nil)
+
 // Client which batches messages and flushes at the given Interval or
 // when the Size limit is exceeded. Set Verbose to true to enable
 // logging output.
 type Client struct {
+	// stats is updated atomically and kept first so its 64-bit fields are
+	// aligned on 32-bit platforms.
+	stats Stats
+
 	Endpoint string
+	// Region uploads to the endpoint of a region of the Segment API, such as
+	// EndpointEU for RegionEU, when Endpoint is left to its default.
+	Region Region
+	// Endpoints overrides Endpoint for the message types it has keys for, such
+	// as "track" or "identify". Messages for different endpoints are batched
+	// separately.
+	Endpoints map[string]string
 	// Interval represents the duration at which messages are flushed. It may be
-	// configured only before any messages are enqueued.
+	// configured only before any messages are enqueued, and later changed
+	// with SetInterval, as Size with SetBatchSize.
 	Interval time.Duration
 	Size     int
 	Logger   *log.Logger
 	Verbose  bool
 	Client   http.Client
+	// StructuredLogger, when set, receives the log messages in place of
+	// Logger, along with fields such as the batch size, retry count and
+	// response status where they apply.
+	StructuredLogger StructuredLogger
+	// HTTPClient, when set, is used for uploads instead of Client. This allows
+	// sharing an existing *http.Client, for example one with instrumented
+	// transports or a custom timeout and redirect policy. Client must then be
+	// left alone: setting both is an error, returned by Enqueue.
+	HTTPClient *http.Client
+	// MaxIdleConns and IdleConnTimeout, when set, tune the pool of connections
+	// of the default transport, cloned from http.DefaultTransport, to reuse
+	// more connections under heavy traffic: MaxIdleConns limits the idle
+	// connections kept, in total and to each endpoint, and IdleConnTimeout how
+	// long they are kept. They are ignored when Client has a Transport, or
+	// when HTTPClient is set.
+	MaxIdleConns    int
+	IdleConnTimeout time.Duration
+	// DryRun writes the batches to DryRunOutput as indented JSON in place of
+	// uploading them, and reports their messages as sent, e.g. to see the
+	// events during development. No requests are made. Batches are logged
+	// when DryRunOutput is nil.
+	DryRun       bool
+	DryRunOutput io.Writer
+	// Gzip enables gzip compression of batch request bodies.
+	Gzip bool
+	// MaxQueueSize is the number of messages that can wait to be batched,
+	// 100 by default, whatever their priority. OverflowPolicy decides what
+	// happens to messages enqueued while it is reached, once there are no
+	// PriorityLow messages left to evict. Both may be configured only before
+	// any messages are enqueued.
+	MaxQueueSize   int
+	OverflowPolicy OverflowPolicy
+	// MaxQueuedBytes, when set, also limits the queue by the serialized size
+	// of its messages, applying the OverflowPolicy when it is exceeded.
+	MaxQueuedBytes int
+	// QueueWarnThreshold, when set, is the fraction of MaxQueueSize past
+	// which a Callback implementing QueueWarningCallback is warned that the
+	// queue is filling up, at most once per minute.
+	QueueWarnThreshold float64
+	// Pressure, when set, is sent a PressureEvent when the queue fills past
+	// the QueueWarnThreshold, or up when it is unset, and when uploads start
+	// failing, so that producers can slow down. Events are dropped rather
+	// than blocking when it is full, and sent again only once the pressure
+	// went away.
+	Pressure chan<- PressureEvent
+	// Sync makes every message be uploaded on its own as it is enqueued,
+	// returning the result of the upload. This suits short-lived processes
+	// such as serverless functions that can't rely on background flushes.
+	Sync bool
+	// MaxRetries caps how many times a failed upload is retried, 9 when zero.
+	// Rejections with a 4xx status other than 429 are not retried, unless
+	// ShouldRetry decides otherwise.
+	MaxRetries int
+	// MaxConcurrentRetries, when set, bounds the number of batches waiting to
+	// be retried, so that they don't pile up during an outage: the batch that
+	// waited the longest is given up on, as failed, to make room for another.
+	MaxConcurrentRetries int
+	// RetryAfter returns how long to wait after the given failed attempt,
+	// counted from 0, see NewBackoffPolicy. Backo is used when it is nil.
+	RetryAfter func(attempt int) time.Duration
+	// ShouldRetry, when set, decides whether a failed upload is retried in
+	// place of the default classification. It is called either with the
+	// response of a request rejected with a status of 400 or more, whose
+	// Body was read already, or with the error of a request that got no
+	// response.
+	ShouldRetry func(res *http.Response, err error) bool
+	// OnRequest and OnResponse, when set, are called around every batch
+	// request, e.g. to audit them, with the response or the error of the
+	// request. They are given copies without a Body, so that they can't
+	// consume what is sent or received.
+	OnRequest  func(req *http.Request)
+	OnResponse func(res *http.Response, err error)
+	// Callback, when set, is notified of the outcome of every message.
+	Callback Callback
+	// OnPanic, when set, is called with what the hooks supplied by the user,
+	// such as the Callback, the Middlewares, OnRequest, ShouldRetry or the
+	// Encoder, panicked with, rather than logging it. The panic is recovered
+	// from either way, so that uploads go on, and the default behavior used
+	// in place of the hook where there is one.
+	OnPanic func(recovered interface{})
+	// ShutdownTimeout bounds how long Close waits for pending uploads, counted
+	// from the call to Close. Once it elapses uploads are aborted and their
+	// messages reported as failed.
+	ShutdownTimeout time.Duration
+	// UserAgent overrides the User-Agent header of batch requests, which
+	// defaults to the library name and version.
+	UserAgent string
+	// SampleRate is the fraction of track, page and screen messages that are
+	// kept, the others are silently discarded when enqueued. The default of 0
+	// disables sampling so that every message is kept.
+	SampleRate float64
+	// AllowedEvents, when set, lists the only track events that are kept,
+	// and BlockedEvents the ones that are discarded, even if allowed. Other
+	// messages are not affected.
+	AllowedEvents []string
+	BlockedEvents []string
+	// Middlewares are applied in order to every enqueued message. An error
+	// from one of them drops the message and is returned by Enqueue, wrapped
+	// in a *ValidationError.
+	Middlewares []Middleware
+	// MaxBatchBytes, when set, limits the serialized size of the messages in a
+	// batch, which is sent early rather than exceeding it. Messages that are
+	// larger on their own are dropped and reported as failed.
+	MaxBatchBytes int
+	// MaxPropertyBytes, when set, limits the serialized size of the
+	// properties, or traits, of a message. Messages exceeding it are rejected
+	// when enqueued.
+	MaxPropertyBytes int
+	// Rand, when set, is the source of the generated message ids, and hence
+	// of sampling decisions, in place of crypto/rand. A seeded *rand.Rand
+	// makes them deterministic in tests. It may be read concurrently by the
+	// client, under a lock.
+	Rand io.Reader
+	// Historical uploads to the import API for backfilling past events.
+	// Messages must then carry their own Timestamp, which is never defaulted
+	// to the current time.
+	Historical bool
+	// BatchPath and HTTPMethod, when set, replace the path and method of the
+	// batch requests, POST to /v1/batch, or /v1/import when Historical, for
+	// collectors with an API of their own such as PUT /ingest.
+	BatchPath  string
+	HTTPMethod string
+	// FreezeTimestampAtEnqueue defaults the Timestamp of messages to the time
+	// they are enqueued, so that it is preserved while the queue is backed
+	// up. It is set by New; when cleared, the Timestamp defaults to the time
+	// the message is uploaded instead.
+	FreezeTimestampAtEnqueue bool
+	// RequireTimestamp rejects messages without a Timestamp with a
+	// FieldError, rather than defaulting it, for pipelines that must only
+	// get the times of events set by the caller. A Timestamp set by the
+	// caller is never changed either way.
+	RequireTimestamp bool
+	// CorrectClockSkew learns the offset of the local clock from that of the
+	// server, from the Date header of its responses, and corrects the SentAt
+	// of batches with it. The offset is smoothed over the responses, for
+	// devices whose clock is badly off.
+	CorrectClockSkew bool
+	// WriteKeyFunc, when set, is called for every upload to get the write key
+	// so that a rotated key is used without recreating the client.
+	WriteKeyFunc func() string
+	// ValidateWriteKey also rejects write keys that don't look like one, as
+	// the function of the same name does, rather than only empty ones.
+	ValidateWriteKey bool
+	// Dedup drops messages whose MessageId was set by the caller and matches
+	// one of the recently enqueued messages.
+	Dedup bool
+	// Headers are added to every batch request. They can't replace the
+	// Authorization, Content-Type and Content-Encoding headers set by the
+	// client, see ContentType, nor the Idempotency-Key set with Idempotent.
+	Headers http.Header
+	// Idempotent sends an Idempotency-Key header with batch requests, the
+	// same for the retries of a batch, so that servers supporting it ingest
+	// a batch once even if a request that timed out actually went through.
+	// It is derived from the message ids, or is the batch id otherwise.
+	Idempotent bool
+	// PartialFailureSupport reads the outcome of every message of a batch
+	// from the body of successful responses, for servers accepting batches
+	// partially. It must have a result per message, in order, such as
+	// {"results": [{"status": 200}, {"status": 400, "message": "invalid"}]}.
+	// Messages with a status of 400 or more are reported as failures with an
+	// *APIError, and are not retried. Other responses report the outcome of
+	// the batch for all of its messages.
+	PartialFailureSupport bool
+	// StrictValidation also rejects the messages that would otherwise be
+	// dropped after being queued, or rejected by the API: the ones with a
+	// malformed Timestamp, or too large to be sent, and those with a value of
+	// an unexpected type for a key of ReservedContext, which are otherwise
+	// only logged. Invalid messages are always rejected by Enqueue, usually
+	// with a *FieldError.
+	StrictValidation bool
+	// ValidateReservedEvents checks the properties of the track messages of
+	// the ReservedEvents against the types defined by the ecommerce spec,
+	// logging the messages with a property of another type, or rejecting them
+	// with StrictValidation.
+	ValidateReservedEvents bool
+	// MaxTimestampSkew, when set, rejects messages with a FieldError if their
+	// Timestamp is further in the future than this, which is usually the sign
+	// of a misconfigured clock.
+	MaxTimestampSkew time.Duration
+	// Encoding of the batch requests, EncodingJSON by default.
+	Encoding Encoding
+	// Encoder, when set, serializes the batch requests in place of the
+	// Encoding and FieldMapping, in a format of its own.
+	Encoder Encoder
+	// ContentType overrides the Content-Type of the batch requests, which is
+	// otherwise that of the Encoder or Encoding, for collectors expecting
+	// another one such as "application/vnd.company.events+json". Gzip
+	// compressed requests keep their Content-Encoding header.
+	ContentType string
+	// FieldMapping renames the fields of the batch requests and of their
+	// messages, e.g. {"type": "event_type"} for a collector expecting
+	// different names. The fields nested in properties, traits or context
+	// are left alone.
+	FieldMapping map[string]string
+	// GenerateMessageID fills in the MessageId of messages not set by the
+	// caller. It is set by New; when cleared, the MessageId is omitted so that
+	// the server assigns one.
+	GenerateMessageID bool
+	// AutoAnonymousId fills in a generated AnonymousId for track, page and
+	// screen messages which have neither a UserId nor an AnonymousId. With
+	// StickyAnonymousId the same one is used for the lifetime of the client.
+	AutoAnonymousId   bool
+	StickyAnonymousId bool
+	// IdentityHasher, when set, replaces the UserId, AnonymousId and
+	// PreviousId of messages that have one with what it returns, such as a
+	// salted hash, so that raw ids aren't sent. It is applied once messages
+	// were validated, and must be safe for concurrent use. Messages it panics
+	// for are dropped as invalid rather than sent with raw ids.
+	IdentityHasher func(id string) string
+	// MaxRequestsPerSecond, when set, throttles the batch requests, retries
+	// included. Batches waiting for their turn hold up the other uploads, and
+	// then the queue, rather than being dropped.
+	MaxRequestsPerSecond float64
+	// HomogeneousBatches only batches messages of the same type together.
+	HomogeneousBatches bool
+	// WorkerCount is the number of batches that may be uploaded concurrently,
+	// 1000 by default. Messages keep their order within a batch, but batches
+	// uploaded concurrently may be received in any order; a WorkerCount of 1
+	// uploads them one after the other.
+	WorkerCount int
+	// RedactKeys are removed from the properties, traits and context of
+	// every message, and from the maps nested in them, such as Traits or
+	// map[string]string values, ignoring case. This happens after the
+	// Middlewares, and once the DefaultContext is merged so that its values
+	// are redacted too. The fields of structs are left alone.
+	RedactKeys []string
+	// DefaultIntegrations are merged into the Integrations of every message.
+	// The merge is shallow: a key set by the message replaces the default
+	// one, e.g. {"All": false} by default and {"Mixpanel": true} for a
+	// message make it go to Mixpanel only.
+	DefaultIntegrations map[string]interface{}
+	// DefaultContext, unlike the package DefaultContext of batches, is merged
+	// into the Context of every message the same way, e.g. to set the app
+	// version once. Keys set by the message take precedence.
+	DefaultContext map[string]interface{}
+	// FlushTimeout, when set, bounds every batch request, cancelling the ones
+	// that take longer so that they are retried.
+	FlushTimeout time.Duration
+	// MaxMessageAge, when set, bounds how long messages are buffered for a
+	// batch: one is sent early, however small, once its oldest message waited
+	// for that long, rather than at the next Interval.
+	MaxMessageAge time.Duration
+	// AdaptiveBatching adjusts the size of batches to the rate messages are
+	// enqueued at, to the number of those enqueued in a second as a moving
+	// average, within MinBatchSize and MaxBatchSize: batches are sent
+	// promptly at low traffic, and fewer larger ones are sent at high traffic.
+	// The bounds default to 1 and Size.
+	AdaptiveBatching bool
+	MinBatchSize     int
+	MaxBatchSize     int
+	// Clock, when set, is used in place of the time package for timestamps,
+	// the flush Interval and the delays between retries, e.g. to control
+	// time in tests.
+	Clock Clock
+	// Store, when set, persists the queued messages until they are uploaded
+	// or given up on, so that the ones left by a crash are replayed by the
+	// next client using the store, once it is started by Start or its first
+	// use. Messages whose upload is aborted by the ShutdownTimeout are kept
+	// for the next client too; implement DropCallback to tell them apart from
+	// failures. Replayed messages are reported to the Callback as
+	// *json.RawMessage. Messages sent in sync mode are not stored.
+	Store Store
+	// StreamTransport, when set, is tried first for every batch upload,
+	// falling back to a batch request when it fails, e.g. while the stream
+	// is disconnected. A short Interval or a small Size then delivers
+	// micro-batches with a low latency.
+	StreamTransport StreamTransport
+	// TraceBatch, when set, is called before uploading a batch of n messages
+	// serialized to size bytes, e.g. to start a span. The returned context is
+	// used for its requests, and end is called with the number of retries and
+	// the final error once the batch was sent or given up on.
+	TraceBatch func(ctx context.Context, n, size int) (_ context.Context, end func(retries int, err error))
+
 	key      string
-	msgs     chan interface{}
+	msgs     chan message
+	flush    chan chan struct{}
+	settings chan func(*Ticker)
+	take     chan chan []interface{}
 	quit     chan struct{}
 	shutdown chan struct{}
-	uid      func() string
-	now      func() time.Time
-	once     sync.Once
-	wg       sync.WaitGroup
+	// closed is set atomically by Close, closemtx guards the closing of msgs.
+	closed   int32
+	closemtx sync.RWMutex
+	// ctx is cancelled to abort uploads when Close times out.
+	ctx     context.Context
+	cancel  context.CancelFunc
+	uid     func() string
+	randmtx sync.Mutex
+	recent  recentIds
+	now     func() time.Time
+	once    sync.Once
+	wg      sync.WaitGroup
+
+	limiter limiter
+	// configErr is the error of the configuration, checked once on first use.
+	configErr  error
+	configOnce sync.Once
+	// urgent queues the PriorityHigh messages ahead of msgs, and low the
+	// PriorityLow ones behind. The three share the MaxQueueSize, as the
+	// slots held by their messages.
+	urgent chan message
+	low    chan message
+	slots  chan struct{}
+	// bytesQueued is the size of the messages in the queue with
+	// MaxQueuedBytes, as recorded in queuedSizes. bytesFreed is closed when
+	// it decreases.
+	bytesQueued int
+	bytesFreed  chan struct{}
+	bytesmtx    sync.Mutex
+	queuedSizes sync.Map
+	// lastWarning is when the callback was last warned about queue depth.
+	lastWarning time.Time
+	warnmtx     sync.Mutex
+	// queuePressure and failPressure are set atomically while the client is
+	// under the pressure of a filled queue or failing uploads.
+	queuePressure int32
+	failPressure  int32
+	// paused is closed by Resume, and nil unless paused.
+	paused   chan struct{}
+	pausemtx sync.Mutex
+	// storeIds maps the stored messages to their id in the Store.
+	storeIds sync.Map
+	// awaiting maps the messages enqueued by EnqueueAwait to their result,
+	// and callbacks those enqueued by EnqueueWithCallback to their Callback.
+	awaiting  sync.Map
+	callbacks sync.Map
+	// skew is the offset estimated for CorrectClockSkew, once skewKnown.
+	skew      time.Duration
+	skewKnown bool
+	skewmtx   sync.Mutex
+
+	// gap is the average time between the messages buffered by the loop,
+	// the last of which was buffered at lastBuffered, with AdaptiveBatching.
+	// They are only used by the loop.
+	gap          time.Duration
+	lastBuffered time.Time
+	// flushed tracks the batches sent for the Flush being handled by the
+	// loop, if any. It is only used by the loop.
+	flushed *sync.WaitGroup
+	// retrying are the slots of the batches waiting to be retried, oldest
+	// first, with MaxConcurrentRetries.
+	retrying []chan struct{}
+	retrymtx sync.Mutex
+	// pooled is Client with the transport tuned by MaxIdleConns and
+	// IdleConnTimeout, created once.
+	pooled     http.Client
+	pooledOnce sync.Once
+
+	// anonymousId is generated once for StickyAnonymousId.
+	anonymousId     string
+	anonymousIdOnce sync.Once
 
 	// These synchronization primitives are used to control how many goroutines
 	// are spawned by the client for uploads.
@@ -135,7 +899,10 @@ type Client struct {
 	upcount int
 }
 
-// New client with write key.
+// New client with write key. The key isn't checked until the client is first
+// used: if it is empty, or rejected by ValidateWriteKey when the field of the
+// same name is set, and WriteKeyFunc isn't set, the error is logged and
+// returned by every Enqueue.
 func New(key string) *Client {
 	c := &Client{
 		Endpoint: Endpoint,
@@ -144,246 +911,2724 @@ func New(key string) *Client {
 		Logger:   log.New(os.Stderr, "segment ", log.LstdFlags),
 		Verbose:  false,
 		Client:   *http.DefaultClient,
+
+		FreezeTimestampAtEnqueue: true,
+		GenerateMessageID:        true,
+
 		key:      key,
-		msgs:     make(chan interface{}, 100),
+		flush:    make(chan chan struct{}),
+		settings: make(chan func(*Ticker)),
+		take:     make(chan chan []interface{}),
 		quit:     make(chan struct{}),
 		shutdown: make(chan struct{}),
-		now:      time.Now,
-		uid:      uid,
 	}
 
 	c.logf("You are currently using the v2 version analytics-go, which is being deprecated. Please update to v3 as soon as you can https://segment.com/docs/sources/server/go/#migrating-from-v2")
 
+	c.uid = c.randomUid
+	c.now = func() time.Time { return c.clock().Now() }
+	c.ctx, c.cancel = context.WithCancel(context.Background())
 	c.upcond.L = &c.upmtx
 	return c
 }
 
-// Alias buffers an "alias" message.
-func (c *Client) Alias(msg *Alias) error {
-	if msg.UserId == "" {
-		return errors.New("You must pass a 'userId'.")
+// ValidateWriteKey returns an error if key is empty or has characters other
+// than those of base64, such as whitespace left over from a secrets file.
+// Enqueue returns the same error for a client created with such a key when
+// Client.ValidateWriteKey is set; call it on startup to fail fast on
+// misconfiguration.
+func ValidateWriteKey(key string) error {
+	if key == "" {
+		return errors.New("write key is empty")
 	}
-
-	if msg.PreviousId == "" {
-		return errors.New("You must pass a 'previousId'.")
+	for _, r := range key {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+		case r == '+', r == '/', r == '=', r == '-', r == '_':
+		default:
+			return fmt.Errorf("invalid write key: unexpected character %q", r)
+		}
 	}
+	return nil
+}
 
-	msg.Type = "alias"
-	c.queue(msg)
-
+// Start the client once its fields are set, rather than on first use, so
+// that the messages left in the Store are replayed right away. It returns the
+// configuration error that Enqueue would, and does nothing once started.
+func (c *Client) Start() error {
+	if err := c.checkConfig(); err != nil {
+		return err
+	}
+	c.once.Do(c.startLoop)
 	return nil
 }
 
+// Alias buffers an "alias" message.
+func (c *Client) Alias(msg *Alias) error {
+	return c.Enqueue(msg)
+}
+
 // Page buffers an "page" message.
 func (c *Client) Page(msg *Page) error {
-	if msg.UserId == "" && msg.AnonymousId == "" {
-		return errors.New("You must pass either an 'anonymousId' or 'userId'.")
-	}
-
-	msg.Type = "page"
-	c.queue(msg)
+	return c.Enqueue(msg)
+}
 
-	return nil
+// Screen buffers a "screen" message.
+func (c *Client) Screen(msg *Screen) error {
+	return c.Enqueue(msg)
 }
 
 // Group buffers an "group" message.
 func (c *Client) Group(msg *Group) error {
-	if msg.GroupId == "" {
-		return errors.New("You must pass a 'groupId'.")
-	}
-
-	if msg.UserId == "" && msg.AnonymousId == "" {
-		return errors.New("You must pass either an 'anonymousId' or 'userId'.")
-	}
-
-	msg.Type = "group"
-	c.queue(msg)
-
-	return nil
+	return c.Enqueue(msg)
 }
 
 // Identify buffers an "identify" message.
 func (c *Client) Identify(msg *Identify) error {
-	if msg.UserId == "" && msg.AnonymousId == "" {
-		return errors.New("You must pass either an 'anonymousId' or 'userId'.")
-	}
-
-	msg.Type = "identify"
-	c.queue(msg)
-
-	return nil
+	return c.Enqueue(msg)
 }
 
 // Track buffers an "track" message.
 func (c *Client) Track(msg *Track) error {
-	if msg.Event == "" {
-		return errors.New("You must pass 'event'.")
+	return c.Enqueue(msg)
+}
+
+// Enqueue buffers any of the *Alias, *Page, *Screen, *Group, *Identify or
+// *Track messages, blocking while the queue is full.
+func (c *Client) Enqueue(msg interface{}) error {
+	return c.EnqueueContext(context.Background(), msg)
+}
+
+// EnqueueContext is like Enqueue but returns ctx.Err() if ctx is done before
+// the message could be accepted into the queue.
+func (c *Client) EnqueueContext(ctx context.Context, msg interface{}) error {
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return ErrClosed
 	}
 
-	if msg.UserId == "" && msg.AnonymousId == "" {
-		return errors.New("You must pass either an 'anonymousId' or 'userId'.")
+	m, err := c.prepare(msg)
+	if err != nil {
+		return err
 	}
+	return c.enqueue(ctx, m, PriorityNormal)
+}
 
-	msg.Type = "track"
-	c.queue(msg)
+// EnqueuePriority is like Enqueue but queues msg with the given priority.
+func (c *Client) EnqueuePriority(msg interface{}, priority Priority) error {
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return ErrClosed
+	}
 
-	return nil
+	m, err := c.prepare(msg)
+	if err != nil {
+		return err
+	}
+	return c.enqueue(context.Background(), m, priority)
 }
 
-func (c *Client) startLoop() {
-	go c.loop()
-}
+// EnqueueAwait is like Enqueue but returns a channel receiving the outcome
+// of the message once it is known: nil when it was uploaded, or the error it
+// was rejected or given up on with. Other messages keep being batched and
+// uploaded in the background as usual.
+func (c *Client) EnqueueAwait(msg interface{}) <-chan error {
+	result := make(chan error, 1)
+	if atomic.LoadInt32(&c.closed) == 1 {
+		result <- ErrClosed
+		return result
+	}
 
-// Queue message.
-func (c *Client) queue(msg message) {
-	c.once.Do(c.startLoop)
-	msg.setMessageId(c.uid())
-	msg.setTimestamp(timestamp(c.now()))
-	c.msgs <- msg
+	m, err := c.prepare(msg)
+	if err != nil {
+		result <- err
+		return result
+	}
+	c.awaiting.Store(m, result)
+	if err := c.enqueue(context.Background(), m, PriorityNormal); err != nil {
+		c.resolve(m, err)
+	}
+	return result
 }
 
-// Close and flush metrics.
-func (c *Client) Close() error {
-	c.once.Do(c.startLoop)
-	c.quit <- struct{}{}
-	close(c.msgs)
-	<-c.shutdown
-	return nil
-}
+// EnqueueWithCallback is like Enqueue but also reports the outcome of the
+// message to callback, in addition to the Callback of the client: its
+// success, or its failure with the error it was dropped or given up on with.
+// When an error is returned, such as ErrQueueFull, it is the outcome of the
+// message and callback isn't called.
+func (c *Client) EnqueueWithCallback(msg interface{}, callback Callback) error {
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return ErrClosed
+	}
 
-func (c *Client) sendAsync(msgs []interface{}) {
-	c.upmtx.Lock()
-	for c.upcount == 1000 {
-		c.upcond.Wait()
+	m, err := c.prepare(msg)
+	if err != nil {
+		return err
 	}
-	c.upcount++
-	c.upmtx.Unlock()
-	c.wg.Add(1)
-	go func() {
-		err := c.send(msgs)
-		if err != nil {
-			c.logf(err.Error())
-		}
-		c.upmtx.Lock()
-		c.upcount--
-		c.upcond.Signal()
-		c.upmtx.Unlock()
-		c.wg.Done()
-	}()
+	held := &heldCallback{Callback: callback, held: true}
+	c.callbacks.Store(m, held)
+	err = c.enqueue(context.Background(), m, PriorityNormal)
+	if err != nil {
+		c.callbacks.Delete(m)
+	}
+	if outcome := held.release(); outcome != nil && err == nil {
+		c.protect(outcome)
+	}
+	return err
 }
 
-// Send batch request.
-func (c *Client) send(msgs []interface{}) error {
-	if len(msgs) == 0 {
-		return nil
+// Callback of a message enqueued by EnqueueWithCallback, whose outcome is
+// held while it is being enqueued, to be discarded if an error is returned.
+type heldCallback struct {
+	Callback
+	mtx     sync.Mutex
+	held    bool
+	outcome func()
+}
+
+// Report the outcome of the message, or hold it until release.
+func (h *heldCallback) report(c *Client, outcome func()) {
+	h.mtx.Lock()
+	if h.held {
+		h.outcome = outcome
+		h.mtx.Unlock()
+		return
 	}
+	h.mtx.Unlock()
+	c.protect(outcome)
+}
 
-	batch := new(Batch)
-	batch.Messages = msgs
-	batch.MessageId = c.uid()
-	batch.SentAt = timestamp(c.now())
-	batch.Context = DefaultContext
+// Stop holding outcomes, returning the one held, if any.
+func (h *heldCallback) release() func() {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.held = false
+	return h.outcome
+}
 
-	b, err := json.Marshal(batch)
-	if err != nil {
-		return fmt.Errorf("error marshalling msgs: %s", err)
+// EnqueueBatch buffers msgs like Enqueue, but only once all of them passed
+// the middlewares and validation. Otherwise the first error is returned and
+// none of them are queued.
+func (c *Client) EnqueueBatch(msgs ...interface{}) error {
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return ErrClosed
 	}
 
-	for i := 0; i < 10; i++ {
-		if err = c.upload(b); err == nil {
-			return nil
+	prepared := make([]message, len(msgs))
+	for i, msg := range msgs {
+		m, err := c.prepare(msg)
+		if err != nil {
+			return err
 		}
-		Backo.Sleep(i)
+		prepared[i] = m
 	}
 
-	return err
+	for _, m := range prepared {
+		if err := c.enqueue(context.Background(), m, PriorityNormal); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// Upload serialized batch message.
-func (c *Client) upload(b []byte) error {
-	url := c.Endpoint + "/v1/batch"
-	req, err := http.NewRequest("POST", url, bytes.NewReader(b))
-	if err != nil {
-		return fmt.Errorf("error creating request: %s", err)
+// Apply the middlewares to msg and validate the result.
+func (c *Client) prepare(msg interface{}) (message, error) {
+	if err := c.checkConfig(); err != nil {
+		return nil, err
 	}
 
-	req.Header.Add("User-Agent", "analytics-go (version: "+Version+")")
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("Content-Length", string(len(b)))
-	req.SetBasicAuth(c.key, "")
+	for _, middleware := range c.Middlewares {
+		var err error
+		if c.protect(func() { msg, err = middleware(msg) }) {
+			return nil, &ValidationError{Err: errors.New("middleware panicked")}
+		}
+		if err != nil {
+			return nil, &ValidationError{Err: err}
+		}
+	}
 
-	res, err := c.Client.Do(req)
-	if err != nil {
-		return fmt.Errorf("error sending request: %s", err)
+	if c.AutoAnonymousId {
+		c.setAnonymousId(msg)
 	}
-	defer res.Body.Close()
 
-	if res.StatusCode < 400 {
-		c.verbose("response %s", res.Status)
-		return nil
+	if err := Validate(msg); err != nil {
+		c.drop(msg, DropInvalid)
+		return nil, err
+	}
+	m := msg.(message)
+	setContext(m, c.DefaultContext)
+	if len(c.RedactKeys) > 0 {
+		c.redact(m)
 	}
 
-	body, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return fmt.Errorf("error reading response body: %s", err)
+	if c.Historical && m.eventTime() == "" {
+		c.drop(msg, DropInvalid)
+		return nil, &FieldError{Field: "timestamp", Reason: "You must pass a 'timestamp' in historical mode."}
+	}
+	if c.RequireTimestamp && m.eventTime() == "" {
+		c.drop(msg, DropInvalid)
+		return nil, &FieldError{Field: "timestamp", Reason: "You must pass a 'timestamp'."}
+	}
+	if err := c.checkSkew(m); err != nil {
+		c.drop(msg, DropInvalid)
+		return nil, err
+	}
+	if err := c.checkPropertySize(m); err != nil {
+		c.drop(msg, DropInvalid)
+		return nil, err
 	}
+	if err := checkContext(m); err != nil {
+		if c.StrictValidation {
+			c.drop(msg, DropInvalid)
+			return nil, err
+		}
+		c.logf("%s", err)
+	}
+	if c.ValidateReservedEvents {
+		if err := checkEvent(m); err != nil {
+			if c.StrictValidation {
+				c.drop(msg, DropInvalid)
+				return nil, err
+			}
+			c.logf("%s", err)
+		}
+	}
+	if c.StrictValidation {
+		if err := c.checkStrict(m); err != nil {
+			c.drop(msg, DropInvalid)
+			return nil, err
+		}
+	}
+	return m, nil
+}
 
-	return fmt.Errorf("response %s: %d – %s", res.Status, res.StatusCode, string(body))
+// Return an error if the client is configured in a way that can't work, the
+// first time it is used, logging it once.
+func (c *Client) checkConfig() error {
+	c.configOnce.Do(func() {
+		if c.HTTPClient != nil && (c.Client.Transport != nil || c.Client.CheckRedirect != nil || c.Client.Jar != nil || c.Client.Timeout != 0) {
+			c.configErr = &ConfigError{Err: errors.New("invalid configuration: HTTPClient and Client can't both be set")}
+		}
+		if c.WriteKeyFunc == nil && (c.key == "" || c.ValidateWriteKey) {
+			if err := ValidateWriteKey(c.key); err != nil {
+				c.configErr = &ConfigError{Err: err}
+			}
+		}
+		if c.configErr != nil {
+			c.logf("%s", c.configErr)
+		}
+	})
+	return c.configErr
 }
 
-// Batch loop.
-func (c *Client) loop() {
-	var msgs []interface{}
-	tick := time.NewTicker(c.Interval)
+// Remove the RedactKeys from the properties, traits and context of m. The
+// maps are copied since callers may share them between messages.
+func (c *Client) redact(m message) {
+	keys := make(map[string]bool, len(c.RedactKeys))
+	for _, key := range c.RedactKeys {
+		keys[strings.ToLower(key)] = true
+	}
 
-	for {
-		select {
-		case msg := <-c.msgs:
-			c.verbose("buffer (%d/%d) %v", len(msgs), c.Size, msg)
-			msgs = append(msgs, msg)
-			if len(msgs) == c.Size {
-				c.verbose("exceeded %d messages – flushing", c.Size)
-				c.sendAsync(msgs)
-				msgs = make([]interface{}, 0, c.Size)
-			}
-		case <-tick.C:
-			if len(msgs) > 0 {
-				c.verbose("interval reached - flushing %d", len(msgs))
-				c.sendAsync(msgs)
-				msgs = make([]interface{}, 0, c.Size)
-			} else {
-				c.verbose("interval reached – nothing to send")
-			}
-		case <-c.quit:
-			tick.Stop()
-			c.verbose("exit requested – draining msgs")
-			// drain the msg channel.
-			for msg := range c.msgs {
-				c.verbose("buffer (%d/%d) %v", len(msgs), c.Size, msg)
-				msgs = append(msgs, msg)
-			}
-			c.verbose("exit requested – flushing %d", len(msgs))
-			c.sendAsync(msgs)
-			c.wg.Wait()
-			c.verbose("exit")
-			c.shutdown <- struct{}{}
-			return
+	for _, p := range []*map[string]interface{}{m.propertiesMap(), m.contextMap()} {
+		if p != nil && *p != nil {
+			*p = redactMap(*p, keys)
 		}
 	}
 }
 
-// Verbose log.
-func (c *Client) verbose(msg string, args ...interface{}) {
-	if c.Verbose {
-		c.Logger.Printf(msg, args...)
+// Return a copy of m and of the maps nested in it without the keys.
+func redactMap(m map[string]interface{}, keys map[string]bool) map[string]interface{} {
+	redacted := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		if !keys[strings.ToLower(k)] {
+			redacted[k] = redactValue(v, keys)
+		}
+	}
+	return redacted
+}
+
+// Return a copy of v without the keys if it is a map, slice or array, of
+// any type such as Traits or map[string]string, or v itself otherwise.
+func redactValue(v interface{}, keys map[string]bool) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return redactMap(v, keys)
+	case []interface{}:
+		values := make([]interface{}, len(v))
+		for i, e := range v {
+			values[i] = redactValue(e, keys)
+		}
+		return values
+	}
+
+	switch reflect.ValueOf(v).Kind() {
+	case reflect.Map, reflect.Slice, reflect.Array:
+		return redactReflect(reflect.ValueOf(v), keys).Interface()
+	}
+	return v
+}
+
+// Return a copy of v without the keys, for maps and slices of other types
+// than those handled by redactValue.
+func redactReflect(v reflect.Value, keys map[string]bool) reflect.Value {
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		return redactReflect(v.Elem(), keys)
+	case reflect.Map:
+		if v.IsNil() || v.Type().Key().Kind() != reflect.String {
+			return v
+		}
+		redacted := reflect.MakeMapWithSize(v.Type(), v.Len())
+		for iter := v.MapRange(); iter.Next(); {
+			if !keys[strings.ToLower(iter.Key().String())] {
+				redacted.SetMapIndex(iter.Key(), redactReflect(iter.Value(), keys))
+			}
+		}
+		return redacted
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		redacted := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			redacted.Index(i).Set(redactReflect(v.Index(i), keys))
+		}
+		return redacted
+	case reflect.Array:
+		redacted := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.Len(); i++ {
+			redacted.Index(i).Set(redactReflect(v.Index(i), keys))
+		}
+		return redacted
+	}
+	return v
+}
+
+// Set a generated anonymousId on track, page and screen messages without
+// identity.
+func (c *Client) setAnonymousId(msg interface{}) {
+	var userId, anonymousId *string
+	switch m := msg.(type) {
+	case *Track:
+		userId, anonymousId = &m.UserId, &m.AnonymousId
+	case *Page:
+		userId, anonymousId = &m.UserId, &m.AnonymousId
+	case *Screen:
+		userId, anonymousId = &m.UserId, &m.AnonymousId
+	default:
+		return
+	}
+	if *userId != "" || *anonymousId != "" {
+		return
+	}
+
+	if !c.StickyAnonymousId {
+		*anonymousId = c.uid()
+		return
+	}
+	c.anonymousIdOnce.Do(func() { c.anonymousId = c.uid() })
+	*anonymousId = c.anonymousId
+}
+
+// Replace the ids of the user of msg with their IdentityHasher hash,
+// returning false if it panicked.
+func (c *Client) hashIdentities(msg message) bool {
+	var ids []*string
+	switch m := msg.(type) {
+	case *Track:
+		ids = []*string{&m.UserId, &m.AnonymousId}
+	case *Page:
+		ids = []*string{&m.UserId, &m.AnonymousId}
+	case *Screen:
+		ids = []*string{&m.UserId, &m.AnonymousId}
+	case *Identify:
+		ids = []*string{&m.UserId, &m.AnonymousId}
+	case *Group:
+		ids = []*string{&m.UserId, &m.AnonymousId}
+	case *Alias:
+		ids = []*string{&m.UserId, &m.PreviousId}
+	}
+	for _, id := range ids {
+		if *id != "" && c.protect(func() { *id = c.IdentityHasher(*id) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// Complete prepared message m and queue it, or send it in sync mode.
+func (c *Client) enqueue(ctx context.Context, m message, priority Priority) error {
+	if !c.complete(m) {
+		return nil
+	}
+
+	if c.Sync {
+		atomic.AddInt64(&c.stats.MessagesEnqueued, 1)
+		return c.send(ctx, c.endpoint(m), []interface{}{m})
+	}
+
+	return c.queue(ctx, m, priority)
+}
+
+// Complete prepared message m with the library, integrations, id and
+// timestamp, returning false if it is dropped as a duplicate or by sampling.
+func (c *Client) complete(m message) bool {
+	if !c.allowed(m) {
+		c.verbose("filtered out %v", m)
+		c.drop(m, DropFiltered)
+		return false
+	}
+
+	setLibrary(m)
+	setIntegrations(m, c.DefaultIntegrations)
+	if c.IdentityHasher != nil && !c.hashIdentities(m) {
+		c.drop(m, DropInvalid)
+		return false
+	}
+
+	if c.Dedup && m.id() != "" && c.recent.seen(m.id()) {
+		c.verbose("dropped duplicate %v", m)
+		atomic.AddInt64(&c.stats.MessagesDropped, 1)
+		c.drop(m, DropDuplicate)
+		return false
+	}
+
+	if c.GenerateMessageID {
+		m.setMessageId(c.uid())
+	}
+	if !c.Historical && c.FreezeTimestampAtEnqueue {
+		m.setTimestamp(timestamp(c.now()))
+	}
+
+	if !c.sampled(m) {
+		c.verbose("sampled out %v", m)
+		c.drop(m, DropSampled)
+		return false
+	}
+	return true
+}
+
+// SendBatch uploads a batch built by the caller to Endpoint right away,
+// bypassing the queue. Its messages are validated and completed like
+// enqueued ones, and are all rejected if one of them is invalid. The context
+// of the batch defaults to DefaultContext, and its MessageId and SentAt are
+// set by the client when it is sent. The Timestamp and SentAt of the
+// messages are never changed once set: the API uses the SentAt of the batch
+// to correct the clock skew of their timestamps.
+func (c *Client) SendBatch(batch *Batch) error {
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return ErrClosed
+	}
+
+	prepared := make([]message, len(batch.Messages))
+	for i, msg := range batch.Messages {
+		m, err := c.prepare(msg)
+		if err != nil {
+			return err
+		}
+		prepared[i] = m
+	}
+
+	var msgs []interface{}
+	for _, m := range prepared {
+		if c.complete(m) {
+			msgs = append(msgs, m)
+		}
+	}
+	atomic.AddInt64(&c.stats.MessagesEnqueued, int64(len(msgs)))
+
+	batchContext := batch.Context
+	if batchContext == nil {
+		batchContext = DefaultContext
+	}
+	return c.sendBatch(c.ctx, c.defaultEndpoint(), batchContext, msgs)
+}
+
+// Return a FieldError if the timestamp of m is more than MaxTimestampSkew
+// ahead of the clock. Timestamps that can't be parsed are left to the API.
+func (c *Client) checkSkew(m message) error {
+	if c.MaxTimestampSkew <= 0 {
+		return nil
+	}
+	t, err := parseTimestamp(m.eventTime())
+	if err != nil {
+		return nil
+	}
+	if skew := t.Sub(c.now()); skew > c.MaxTimestampSkew {
+		return &FieldError{
+			Field:  "timestamp",
+			Value:  m.eventTime(),
+			Reason: fmt.Sprintf("%s in the future exceeds the %s tolerance", skew, c.MaxTimestampSkew),
+		}
+	}
+	return nil
+}
+
+// Return an error if the properties of m exceed the MaxPropertyBytes.
+func (c *Client) checkPropertySize(m message) error {
+	if c.MaxPropertyBytes <= 0 {
+		return nil
+	}
+	properties := m.propertiesMap()
+	if properties == nil || len(*properties) == 0 {
+		return nil
+	}
+
+	b, err := json.Marshal(*properties)
+	if err != nil {
+		return &ValidationError{Err: fmt.Errorf("error marshalling msg properties: %s", err)}
+	}
+	if len(b) > c.MaxPropertyBytes {
+		field := "properties"
+		switch m.typ() {
+		case "identify", "group":
+			field = "traits"
+		}
+		return &FieldError{Field: field, Value: len(b), Reason: fmt.Sprintf("exceeds the %d bytes limit", c.MaxPropertyBytes)}
+	}
+	return nil
+}
+
+// ReservedContext lists the keys of the Context of messages that the API
+// handles specially, with the JSON type of the values it expects for them:
+// "object", "string" or "boolean". Other values are rejected or silently
+// normalized by the API, e.g. a string of "traits", so messages having some
+// are logged, or rejected with StrictValidation.
+var ReservedContext = map[string]string{
+	"active":    "boolean",
+	"app":       "object",
+	"campaign":  "object",
+	"device":    "object",
+	"groupId":   "string",
+	"ip":        "string",
+	"library":   "object",
+	"locale":    "string",
+	"location":  "object",
+	"network":   "object",
+	"os":        "object",
+	"page":      "object",
+	"referrer":  "object",
+	"screen":    "object",
+	"timezone":  "string",
+	"traits":    "object",
+	"userAgent": "string",
+}
+
+// Return a FieldError for the first key of the Context of m whose value
+// isn't of the type expected by ReservedContext.
+func checkContext(m message) error {
+	return checkKinds("context", *m.contextMap(), ReservedContext)
+}
+
+// ReservedEvents lists the track events of the Segment ecommerce spec, with
+// the JSON types of the properties it defines for them, which are checked
+// with ValidateReservedEvents.
+var ReservedEvents = map[string]map[string]string{
+	"Products Searched":     {"query": "string"},
+	"Product List Viewed":   {"list_id": "string", "category": "string", "products": "array"},
+	"Product List Filtered": {"list_id": "string", "filters": "array", "sorts": "array", "products": "array"},
+	"Product Clicked":       productProperties,
+	"Product Viewed":        productProperties,
+	"Product Added":         productProperties,
+	"Product Removed":       productProperties,
+	"Cart Viewed":           {"cart_id": "string", "products": "array"},
+	"Checkout Started":      orderProperties,
+	"Order Completed":       orderProperties,
+	"Order Updated":         orderProperties,
+	"Order Refunded":        orderProperties,
+	"Order Cancelled":       orderProperties,
+	"Coupon Entered":        couponProperties,
+	"Coupon Applied":        couponProperties,
+	"Coupon Denied":         couponProperties,
+	"Coupon Removed":        couponProperties,
+	"Promotion Viewed":      {"promotion_id": "string", "creative": "string", "name": "string", "position": "string"},
+	"Promotion Clicked":     {"promotion_id": "string", "creative": "string", "name": "string", "position": "string"},
+}
+
+var productProperties = map[string]string{
+	"product_id": "string",
+	"sku":        "string",
+	"category":   "string",
+	"name":       "string",
+	"brand":      "string",
+	"variant":    "string",
+	"price":      "number",
+	"quantity":   "number",
+	"coupon":     "string",
+	"position":   "number",
+	"url":        "string",
+	"image_url":  "string",
+}
+
+var orderProperties = map[string]string{
+	"order_id": "string",
+	"total":    "number",
+	"revenue":  "number",
+	"shipping": "number",
+	"tax":      "number",
+	"discount": "number",
+	"coupon":   "string",
+	"currency": "string",
+	"products": "array",
+}
+
+var couponProperties = map[string]string{
+	"order_id":  "string",
+	"cart_id":   "string",
+	"coupon_id": "string",
+}
+
+// Return a FieldError for the first property of m, if it is a track message
+// of one of the ReservedEvents, whose value isn't of the type expected.
+func checkEvent(m message) error {
+	track, ok := m.(*Track)
+	if !ok {
+		return nil
+	}
+	expected, ok := ReservedEvents[track.Event]
+	if !ok {
+		return nil
+	}
+	err := checkKinds("properties", track.Properties, expected)
+	if e, ok := err.(*FieldError); ok {
+		e.Reason += fmt.Sprintf(" for the '%s' event", track.Event)
+	}
+	return err
+}
+
+// Return a FieldError for the first key, in order, of values whose value
+// isn't of the JSON type expected for it. Keys without one are ignored, as
+// are null values.
+func checkKinds(field string, values map[string]interface{}, expected map[string]string) error {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		want, ok := expected[key]
+		if !ok || values[key] == nil {
+			continue
+		}
+		if kind := jsonKind(values[key]); kind != "" && kind != want {
+			return &FieldError{Field: field + "." + key, Value: values[key], Reason: fmt.Sprintf("expected a JSON %s, got a %s", want, kind)}
+		}
+	}
+	return nil
+}
+
+// Return the JSON type v is marshalled as, or "" if it marshals itself.
+func jsonKind(v interface{}) string {
+	switch v.(type) {
+	case json.Marshaler:
+		return ""
+	case encoding.TextMarshaler:
+		return "string"
+	}
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return "null"
+		}
+		rv = rv.Elem()
+	}
+	switch rv.Kind() {
+	case reflect.Map, reflect.Struct:
+		return "object"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	default:
+		return "number"
+	}
+}
+
+// Return an error for m if it is not certain to be accepted by the API:
+// if its timestamp can't be parsed, or if it can't be serialized within the
+// batch size limit.
+func (c *Client) checkStrict(m message) error {
+	if ts := m.eventTime(); ts != "" {
+		if _, err := parseTimestamp(ts); err != nil {
+			return &FieldError{Field: "timestamp", Value: ts, Reason: "not an ISO 8601 timestamp"}
+		}
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return &ValidationError{Err: fmt.Errorf("error marshalling msg: %s", err)}
+	}
+	limit := c.MaxBatchBytes
+	if limit <= 0 {
+		limit = maxBatchBytes
+	}
+	if len(b) > limit {
+		return &ValidationError{Err: fmt.Errorf("msg of %d bytes exceeds the %d bytes batch limit", len(b), limit)}
+	}
+	return nil
+}
+
+// Parse an ISO 8601 timestamp, as formatted by timestamp or RFC 3339.
+func parseTimestamp(s string) (time.Time, error) {
+	t, err := time.Parse("2006-01-02T15:04:05-0700", s)
+	if err != nil {
+		t, err = time.Parse(time.RFC3339Nano, s)
+	}
+	return t, err
+}
+
+func (c *Client) startLoop() {
+	size := c.MaxQueueSize
+	if size <= 0 {
+		size = 100
+	}
+	c.msgs = make(chan message, size)
+	c.urgent = make(chan message, size)
+	c.low = make(chan message, size)
+	c.slots = make(chan struct{}, size)
+	if c.Store != nil {
+		c.wg.Add(1)
+		go c.replay(c.Size)
+	}
+	go c.loop(c.clock().NewTicker(c.Interval))
+}
+
+// Validate the structure of msg, its type and required fields, and that it
+// fits in a batch once serialized, as the client does before queueing it,
+// without queueing anything. The checks that depend on the configuration of
+// a client, such as RequireTimestamp, MaxPropertyBytes or StrictValidation,
+// are not applied. The Type of a valid msg is set, as when it is enqueued.
+func Validate(msg interface{}) error {
+	m, ok := msg.(message)
+	if !ok {
+		return &ValidationError{Err: fmt.Errorf("unsupported message type %T", msg)}
+	}
+	if err := m.validate(); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return &ValidationError{Err: fmt.Errorf("error marshalling msg: %s", err)}
+	}
+	if len(b) > maxBatchBytes {
+		return &ValidationError{Err: fmt.Errorf("msg of %d bytes exceeds the %d bytes batch limit", len(b), maxBatchBytes)}
+	}
+	return nil
+}
+
+// Set the library in the context of msg unless it already has one. The
+// context is copied since callers may share it between messages.
+func setLibrary(msg message) {
+	ctx := msg.contextMap()
+	if _, ok := (*ctx)["library"]; ok {
+		return
+	}
+
+	merged := make(map[string]interface{}, len(*ctx)+1)
+	for k, v := range *ctx {
+		merged[k] = v
+	}
+	merged["library"] = library
+	*ctx = merged
+}
+
+// Merge the default integrations into those of msg, which take precedence.
+// The merge is shallow, and a copy is made as for setLibrary.
+func setIntegrations(msg message, defaults map[string]interface{}) {
+	mergeDefaults(msg.integrationsMap(), defaults)
+}
+
+// Merge the default context into that of msg, in the same way.
+func setContext(msg message, defaults map[string]interface{}) {
+	mergeDefaults(msg.contextMap(), defaults)
+}
+
+// Replace *m with a copy of it completed with the defaults it lacks.
+func mergeDefaults(m *map[string]interface{}, defaults map[string]interface{}) {
+	if len(defaults) == 0 {
+		return
+	}
+
+	merged := make(map[string]interface{}, len(defaults)+len(*m))
+	for k, v := range defaults {
+		merged[k] = v
+	}
+	for k, v := range *m {
+		merged[k] = v
+	}
+	*m = merged
+}
+
+// Report whether msg passes the AllowedEvents and BlockedEvents.
+func (c *Client) allowed(msg message) bool {
+	track, ok := msg.(*Track)
+	if !ok {
+		return true
+	}
+
+	for _, event := range c.BlockedEvents {
+		if event == track.Event {
+			return false
+		}
+	}
+	if len(c.AllowedEvents) == 0 {
+		return true
+	}
+	for _, event := range c.AllowedEvents {
+		if event == track.Event {
+			return true
+		}
+	}
+	return false
+}
+
+// Report whether msg is kept by sampling. The decision is based on the
+// message id so it is the same every time a message is enqueued. Identify,
+// alias and group messages are always kept.
+func (c *Client) sampled(msg message) bool {
+	if c.SampleRate <= 0 || c.SampleRate >= 1 {
+		return true
+	}
+
+	switch msg.typ() {
+	case "identify", "alias", "group":
+		return true
+	}
+
+	id := msg.id()
+	if id == "" {
+		id = c.uid()
+	}
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	return float64(h.Sum64()%1000000) < c.SampleRate*1000000
+}
+
+// Queue message.
+func (c *Client) queue(ctx context.Context, msg message, priority Priority) error {
+	c.once.Do(c.startLoop)
+
+	c.closemtx.RLock()
+	defer c.closemtx.RUnlock()
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return ErrClosed
+	}
+
+	if err := c.store(msg); err != nil {
+		return err
+	}
+
+	queue, policy := c.msgs, c.OverflowPolicy
+	switch priority {
+	case PriorityHigh:
+		queue = c.urgent
+	case PriorityLow:
+		queue, policy = c.low, DropNewest
+	}
+
+	atomic.AddInt64(&c.stats.QueueLength, 1)
+	if c.MaxQueuedBytes > 0 {
+		if err := c.reserve(ctx, msg, priority, policy); err == ErrQueueFull {
+			c.dropQueued(1)
+			c.unstore([]interface{}{msg}, nil)
+			c.drop(msg, DropQueueFull)
+			return err
+		} else if err != nil {
+			atomic.AddInt64(&c.stats.QueueLength, -1)
+			c.unstore([]interface{}{msg}, nil)
+			return err
+		}
+	}
+
+	// the send can't block once a slot is held, as every queue has room for
+	// all of them.
+	for {
+		select {
+		case c.slots <- struct{}{}:
+			queue <- msg
+			atomic.AddInt64(&c.stats.MessagesEnqueued, 1)
+			c.checkDepth()
+			return nil
+		default:
+		}
+
+		if c.evict(priority, policy) {
+			continue
+		}
+		if policy == BlockOnFull {
+			break
+		}
+		c.release(msg)
+		c.dropQueued(1)
+		c.unstore([]interface{}{msg}, nil)
+		c.drop(msg, DropQueueFull)
+		return ErrQueueFull
+	}
+
+	select {
+	case c.slots <- struct{}{}:
+		queue <- msg
+		atomic.AddInt64(&c.stats.MessagesEnqueued, 1)
+		c.checkDepth()
+		return nil
+	case <-ctx.Done():
+		c.release(msg)
+		atomic.AddInt64(&c.stats.QueueLength, -1)
+		c.unstore([]interface{}{msg}, nil)
+		return ctx.Err()
+	}
+}
+
+// Warn the callback if the queue is filled past the QueueWarnThreshold,
+// unless it was already warned within the last minute, and report the
+// pressure it is under.
+func (c *Client) checkDepth() {
+	if c.QueueWarnThreshold <= 0 && c.Pressure == nil {
+		return
+	}
+
+	depth, capacity := len(c.slots), cap(c.slots)
+	threshold := c.QueueWarnThreshold
+	if threshold <= 0 {
+		threshold = 1
+	}
+	over := float64(depth) >= threshold*float64(capacity)
+	c.pressure(&c.queuePressure, over, PressureEvent{QueueLength: depth, QueueCapacity: capacity})
+
+	callback, ok := c.Callback.(QueueWarningCallback)
+	if !ok || !over || c.QueueWarnThreshold <= 0 {
+		return
+	}
+
+	c.warnmtx.Lock()
+	now := c.now()
+	if !c.lastWarning.IsZero() && now.Sub(c.lastWarning) < time.Minute {
+		c.warnmtx.Unlock()
+		return
+	}
+	c.lastWarning = now
+	c.warnmtx.Unlock()
+
+	c.verbose("queue at %d of %d msgs", depth, capacity)
+	c.protect(func() { callback.QueueWarning(depth, capacity) })
+}
+
+// Send event to the Pressure channel if the client comes under the pressure
+// tracked by flag, without blocking.
+func (c *Client) pressure(flag *int32, on bool, event PressureEvent) {
+	if c.Pressure == nil {
+		return
+	}
+	if !on {
+		atomic.StoreInt32(flag, 0)
+		return
+	}
+	if atomic.CompareAndSwapInt32(flag, 0, 1) {
+		select {
+		case c.Pressure <- event:
+		default:
+		}
+	}
+}
+
+// Report the pressure of failing uploads, which ends with a successful one.
+func (c *Client) uploadFailing(err error) {
+	c.pressure(&c.failPressure, err != nil, PressureEvent{
+		QueueLength:   len(c.slots),
+		QueueCapacity: cap(c.slots),
+		Err:           err,
+	})
+}
+
+// Evict a queued message to make room for one of the given priority, if
+// any, returning whether there was one: the oldest PriorityLow message, or
+// with DropOldest the oldest normal message, then for PriorityHigh the oldest
+// high priority one. PriorityLow messages evict none.
+func (c *Client) evict(priority Priority, policy OverflowPolicy) bool {
+	if priority == PriorityLow {
+		return false
+	}
+	queues := []chan message{c.low}
+	if policy == DropOldest {
+		queues = append(queues, c.msgs)
+		if priority == PriorityHigh {
+			queues = append(queues, c.urgent)
+		}
+	}
+	for _, queue := range queues {
+		if c.dropOldest(queue) {
+			return true
+		}
+	}
+	return false
+}
+
+// Evict the oldest message of queue, if any, returning whether there was one.
+func (c *Client) dropOldest(queue chan message) bool {
+	select {
+	case old := <-queue:
+		c.verbose("queue full – dropped oldest msg")
+		c.dequeued(old)
+		c.dropQueued(1)
+		c.unstore([]interface{}{old}, nil)
+		c.drop(old, DropQueueFull)
+		return true
+	default:
+		return false
+	}
+}
+
+// Account for the serialized size of msg in the queued bytes, evicting
+// messages as for the MaxQueueSize until they are within MaxQueuedBytes. A
+// message is always let into an empty queue, however large.
+func (c *Client) reserve(ctx context.Context, msg message, priority Priority, policy OverflowPolicy) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("error marshalling msg: %s", err)
+	}
+	size := len(b)
+
+	for {
+		c.bytesmtx.Lock()
+		if c.bytesQueued == 0 || c.bytesQueued+size <= c.MaxQueuedBytes {
+			c.bytesQueued += size
+			c.bytesmtx.Unlock()
+			c.queuedSizes.Store(msg, size)
+			return nil
+		}
+		if c.bytesFreed == nil {
+			c.bytesFreed = make(chan struct{})
+		}
+		freed := c.bytesFreed
+		c.bytesmtx.Unlock()
+
+		if c.evict(priority, policy) {
+			continue
+		}
+		if policy != BlockOnFull {
+			return ErrQueueFull
+		}
+
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Free the slot and the queued bytes of msg, taken off its queue.
+func (c *Client) dequeued(msg message) {
+	c.release(msg)
+	<-c.slots
+}
+
+// Release the queued bytes of msg once it left the queue.
+func (c *Client) release(msg message) {
+	size, ok := c.queuedSizes.Load(msg)
+	if !ok {
+		return
+	}
+	c.queuedSizes.Delete(msg)
+
+	c.bytesmtx.Lock()
+	defer c.bytesmtx.Unlock()
+	c.bytesQueued -= size.(int)
+	if c.bytesFreed != nil {
+		close(c.bytesFreed)
+		c.bytesFreed = nil
+	}
+}
+
+// Persist msg to the store, if any.
+func (c *Client) store(msg message) error {
+	if c.Store == nil {
+		return nil
+	}
+
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("error marshalling msg: %s", err)
+	}
+	id, err := c.Store.Put(b)
+	if err != nil {
+		return fmt.Errorf("error storing msg: %s", err)
+	}
+	c.storeIds.Store(msg, id)
+	return nil
+}
+
+// Remove msgs from the store once they are done with, or release them for
+// the next client if their upload was aborted by the ShutdownTimeout. Those
+// that failed otherwise were given up on, and reported as such.
+func (c *Client) unstore(msgs []interface{}, err error) {
+	if c.Store == nil {
+		return
+	}
+
+	var ids []string
+	for _, msg := range msgs {
+		if id, ok := c.storeIds.Load(msg); ok {
+			c.storeIds.Delete(msg)
+			ids = append(ids, id.(string))
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+
+	if err != nil && c.ctx.Err() != nil {
+		err = c.Store.Nack(ids...)
+	} else {
+		err = c.Store.Ack(ids...)
+	}
+	if err != nil {
+		c.logf("error updating stored msgs: %s", err)
+	}
+}
+
+// Upload the messages left in the store by a previous process, to the
+// endpoint of their type. It stops at the first batch that fails, leaving the
+// rest for next time.
+func (c *Client) replay(size int) {
+	defer c.wg.Done()
+
+	for {
+		stored, err := c.Store.Get(size)
+		if err != nil {
+			c.logf("error reading stored msgs: %s", err)
+			return
+		}
+		if len(stored) == 0 {
+			return
+		}
+
+		c.verbose("replaying %d stored msgs", len(stored))
+		var endpoints []string
+		batches := make(map[string][]interface{})
+		for _, s := range stored {
+			var m struct {
+				Type string `json:"type"`
+			}
+			json.Unmarshal(s.Data, &m)
+			endpoint := c.typeEndpoint(m.Type)
+			if _, ok := batches[endpoint]; !ok {
+				endpoints = append(endpoints, endpoint)
+			}
+
+			msg := json.RawMessage(s.Data)
+			c.storeIds.Store(&msg, s.Id)
+			batches[endpoint] = append(batches[endpoint], &msg)
+		}
+		for _, endpoint := range endpoints {
+			if err := c.send(c.ctx, endpoint, batches[endpoint]); err != nil {
+				c.logf("error replaying stored msgs: %s", err)
+				return
+			}
+		}
+	}
+}
+
+// Stats returns a snapshot of the client's counters. It is safe to call
+// concurrently with the other methods.
+func (c *Client) Stats() Stats {
+	return Stats{
+		MessagesEnqueued: atomic.LoadInt64(&c.stats.MessagesEnqueued),
+		QueueLength:      atomic.LoadInt64(&c.stats.QueueLength),
+		MessagesInFlight: atomic.LoadInt64(&c.stats.MessagesInFlight),
+		MessagesSent:     atomic.LoadInt64(&c.stats.MessagesSent),
+		MessagesDropped:  atomic.LoadInt64(&c.stats.MessagesDropped),
+		BatchesSent:      atomic.LoadInt64(&c.stats.BatchesSent),
+		RetriesTotal:     atomic.LoadInt64(&c.stats.RetriesTotal),
+
+		UncompressedBytes: atomic.LoadInt64(&c.stats.UncompressedBytes),
+		CompressedBytes:   atomic.LoadInt64(&c.stats.CompressedBytes),
+	}
+}
+
+// Account for n queued messages that are dropped without being uploaded.
+func (c *Client) dropQueued(n int) {
+	atomic.AddInt64(&c.stats.QueueLength, -int64(n))
+	atomic.AddInt64(&c.stats.MessagesDropped, int64(n))
+}
+
+// Interval at which WaitForEmpty checks the queue.
+const emptyPollInterval = 10 * time.Millisecond
+
+// WaitForEmpty blocks until nothing is queued nor being uploaded, e.g. for
+// a test to wait for the messages it enqueued to be sent, or until ctx is
+// done, returning ctx.Err(). Unlike Flush it doesn't send the messages right
+// away, they are uploaded at the next Interval, and it keeps waiting for
+// those enqueued in the meantime.
+func (c *Client) WaitForEmpty(ctx context.Context) error {
+	ticker := time.NewTicker(emptyPollInterval)
+	defer ticker.Stop()
+	for {
+		if c.empty() {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Return whether nothing is queued nor being uploaded.
+func (c *Client) empty() bool {
+	if atomic.LoadInt64(&c.stats.QueueLength) != 0 || atomic.LoadInt64(&c.stats.MessagesInFlight) != 0 {
+		return false
+	}
+	c.upmtx.Lock()
+	defer c.upmtx.Unlock()
+	return c.upcount == 0
+}
+
+// Flush sends the messages queued so far and blocks until their upload has
+// completed or failed. Batches that were already being uploaded are not
+// waited for, nor are the messages enqueued in the meantime, which keep being
+// batched as usual. Unlike Close the client remains usable afterwards.
+func (c *Client) Flush() error {
+	return c.FlushContext(context.Background())
+}
+
+// FlushContext is like Flush but gives up waiting once ctx is done,
+// returning ctx.Err(). The messages keep being uploaded in the background.
+// It returns nil right away when nothing is queued.
+func (c *Client) FlushContext(ctx context.Context) error {
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return ErrClosed
+	}
+
+	if atomic.LoadInt64(&c.stats.QueueLength) == 0 {
+		return nil
+	}
+
+	c.once.Do(c.startLoop)
+	done := make(chan struct{})
+	select {
+	case c.flush <- done:
+	case <-c.shutdown:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close and flush metrics. A summary of the Stats is logged once closed.
+func (c *Client) Close() error {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return ErrClosed
+	}
+
+	start := c.clock().Now()
+	defer func() { c.logSummary(c.clock().Now().Sub(start)) }()
+
+	// the timeout includes the wait for the loop, which may be held up by
+	// uploads, e.g. waiting for one of the WorkerCount to be free.
+	var timeout <-chan time.Time
+	if c.ShutdownTimeout > 0 {
+		timeout = c.clock().After(c.ShutdownTimeout)
+	}
+	timedOut := false
+	abort := func() {
+		c.verbose("shutdown timeout reached – aborting uploads")
+		c.cancel()
+		timeout, timedOut = nil, true
+	}
+
+	c.Resume()
+	c.once.Do(c.startLoop)
+	select {
+	case c.quit <- struct{}{}:
+	case <-timeout:
+		abort()
+		c.quit <- struct{}{}
+	}
+	// wait for the messages being enqueued before closing the queue.
+	c.closemtx.Lock()
+	close(c.urgent)
+	close(c.msgs)
+	close(c.low)
+	c.closemtx.Unlock()
+
+	select {
+	case <-c.shutdown:
+	case <-timeout:
+		abort()
+		<-c.shutdown
+	}
+	if timedOut {
+		return fmt.Errorf("shutdown timed out after %s, pending messages were dropped", c.ShutdownTimeout)
+	}
+	return nil
+}
+
+// Log the Stats of the client once it was closed, in duration.
+func (c *Client) logSummary(duration time.Duration) {
+	stats := c.Stats()
+	c.log("info", map[string]interface{}{
+		"messages_sent":    stats.MessagesSent,
+		"batches_sent":     stats.BatchesSent,
+		"messages_dropped": stats.MessagesDropped,
+		"retries":          stats.RetriesTotal,
+		"duration":         duration.String(),
+	}, "closed in %s – sent %d msgs in %d batches, dropped %d msgs, retried %d times",
+		duration, stats.MessagesSent, stats.BatchesSent, stats.MessagesDropped, stats.RetriesTotal)
+}
+
+// WarmUp makes a HEAD request to the endpoints, so that the connections,
+// including their TLS handshake, are established before the first upload.
+// Any response will do; failures are logged and the first one is returned,
+// but the client remains usable regardless. It does nothing with DryRun.
+func (c *Client) WarmUp(ctx context.Context) error {
+	if c.DryRun {
+		return nil
+	}
+
+	endpoints := map[string]bool{c.defaultEndpoint(): true}
+	for _, endpoint := range c.Endpoints {
+		endpoints[endpoint] = true
+	}
+
+	var first error
+	for endpoint := range endpoints {
+		if err := c.warmUp(ctx, endpoint); err != nil {
+			c.logf("error warming up %s: %s", endpoint, err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+func (c *Client) warmUp(ctx context.Context, endpoint string) error {
+	req, err := http.NewRequest("HEAD", endpoint+c.batchPath(), nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", c.userAgent())
+
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	c.verbose("warmed up %s – %s", endpoint, res.Status)
+	return nil
+}
+
+// SetInterval changes the Interval at which messages are flushed, starting
+// with the next one. Unlike changing the field, it is safe to call while the
+// client is in use.
+func (c *Client) SetInterval(d time.Duration) error {
+	if d <= 0 {
+		return fmt.Errorf("invalid interval %s: must be positive", d)
+	}
+	return c.set(func(tick *Ticker) {
+		(*tick).Stop()
+		*tick = c.clock().NewTicker(d)
+		c.Interval = d
+	})
+}
+
+// SetBatchSize changes the Size limit of batches, taking effect with the
+// next message buffered. Unlike changing the field, it is safe to call while
+// the client is in use.
+func (c *Client) SetBatchSize(n int) error {
+	if n <= 0 {
+		return fmt.Errorf("invalid batch size %d: must be positive", n)
+	}
+	return c.set(func(*Ticker) { c.Size = n })
+}
+
+// Apply a change of settings from the batch loop, which owns them.
+func (c *Client) set(f func(tick *Ticker)) error {
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return ErrClosed
+	}
+
+	c.once.Do(c.startLoop)
+	select {
+	case c.settings <- f:
+		return nil
+	case <-c.shutdown:
+		return ErrClosed
+	}
+}
+
+// Reset discards the queued messages without sending them or reporting them
+// to the Callback, zeroes the Stats counters and forgets the message ids seen
+// for Dedup, so that the client can be reused as if new, e.g. between the
+// cases of a test. Uploads in progress are not affected. It is meant for tests
+// only, not for production use.
+func (c *Client) Reset() error {
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return ErrClosed
+	}
+
+	msgs, err := c.takeQueued()
+	if err != nil {
+		return err
+	}
+	c.verbose("reset – discarded %d msgs", len(msgs))
+	c.forget(msgs, "reset")
+
+	atomic.StoreInt64(&c.stats.MessagesEnqueued, 0)
+	atomic.StoreInt64(&c.stats.MessagesSent, 0)
+	atomic.StoreInt64(&c.stats.BatchesSent, 0)
+	atomic.StoreInt64(&c.stats.MessagesDropped, 0)
+	atomic.StoreInt64(&c.stats.RetriesTotal, 0)
+	atomic.StoreInt64(&c.stats.UncompressedBytes, 0)
+	atomic.StoreInt64(&c.stats.CompressedBytes, 0)
+	c.recent.reset()
+	c.warnmtx.Lock()
+	c.lastWarning = time.Time{}
+	c.warnmtx.Unlock()
+	atomic.StoreInt32(&c.queuePressure, 0)
+	atomic.StoreInt32(&c.failPressure, 0)
+	return nil
+}
+
+// Export takes the messages queued off the queue without sending them, and
+// writes them to w as newline-delimited JSON, e.g. to hand them over to
+// another system. They are not reported to the Callback, and are taken off
+// the queue even if writing them fails. Once the client is closed, there is
+// nothing left to export: the messages were flushed by Close.
+func (c *Client) Export(w io.Writer) error {
+	msgs, err := c.takeQueued()
+	if err == ErrClosed {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	c.verbose("export – exporting %d msgs", len(msgs))
+	defer c.forget(msgs, "exported")
+
+	enc := json.NewEncoder(w)
+	for _, msg := range msgs {
+		if err := enc.Encode(msg); err != nil {
+			return fmt.Errorf("error exporting msgs: %s", err)
+		}
+	}
+	return nil
+}
+
+// Take the messages queued, or buffered by the loop, off the queue.
+func (c *Client) takeQueued() ([]interface{}, error) {
+	c.once.Do(c.startLoop)
+	taken := make(chan []interface{}, 1)
+	select {
+	case c.take <- taken:
+		return <-taken, nil
+	case <-c.shutdown:
+		return nil, ErrClosed
+	}
+}
+
+// Take the messages queued, and those buffered in msgs, for takeQueued.
+func (c *Client) takeAll(msgs map[batchKey]*pending) []interface{} {
+	// buffered messages were queued first.
+	var taken []interface{}
+	for key, p := range msgs {
+		taken = append(taken, p.msgs...)
+		delete(msgs, key)
+	}
+	for _, queue := range []chan message{c.urgent, c.msgs, c.low} {
+		for n := len(queue); n > 0; n-- {
+			msg := <-queue
+			c.dequeued(msg)
+			taken = append(taken, msg)
+		}
+	}
+
+	atomic.AddInt64(&c.stats.QueueLength, -int64(len(taken)))
+	return taken
+}
+
+// Forget msgs taken off the queue, resolving them as dropped for reason.
+func (c *Client) forget(msgs []interface{}, reason string) {
+	for _, msg := range msgs {
+		c.resolve(msg, fmt.Errorf("%w: %s", ErrDropped, reason))
+	}
+	c.unstore(msgs, nil)
+}
+
+// Pause uploads until Resume is called. Messages keep being accepted into
+// the queue, subject to the OverflowPolicy once it is full, and Flush blocks
+// until uploads are resumed. Uploads in progress finish their current
+// request, but don't attempt another one.
+func (c *Client) Pause() {
+	c.pausemtx.Lock()
+	defer c.pausemtx.Unlock()
+	if c.paused == nil {
+		c.paused = make(chan struct{})
+	}
+}
+
+// Resume uploads after Pause. Close resumes them as well.
+func (c *Client) Resume() {
+	c.pausemtx.Lock()
+	defer c.pausemtx.Unlock()
+	if c.paused != nil {
+		close(c.paused)
+		c.paused = nil
+	}
+}
+
+// Return a channel closed on Resume if uploads are paused, nil otherwise.
+func (c *Client) resumed() chan struct{} {
+	c.pausemtx.Lock()
+	defer c.pausemtx.Unlock()
+	return c.paused
+}
+
+// ShutdownStats reports the outcome of closing a client.
+type ShutdownStats struct {
+	// Flushed counts the messages uploaded while closing, and Dropped those
+	// given up on, including the ones aborted by the ShutdownTimeout.
+	Flushed int
+	Dropped int
+}
+
+// CloseWithStats is like Close but also reports what happened to the
+// messages that were pending.
+func (c *Client) CloseWithStats() (ShutdownStats, error) {
+	before := c.Stats()
+	err := c.Close()
+	if err == ErrClosed {
+		return ShutdownStats{}, err
+	}
+
+	after := c.Stats()
+	return ShutdownStats{
+		Flushed: int(after.MessagesSent - before.MessagesSent),
+		Dropped: int(after.MessagesDropped - before.MessagesDropped),
+	}, err
+}
+
+func (c *Client) sendAsync(endpoint string, msgs []interface{}) {
+	c.upmtx.Lock()
+	workers := c.WorkerCount
+	if workers <= 0 {
+		workers = 1000
+	}
+	for c.upcount >= workers {
+		c.upcond.Wait()
+	}
+	c.upcount++
+	c.upmtx.Unlock()
+	// the messages are dequeued once counted as uploading, see empty.
+	atomic.AddInt64(&c.stats.QueueLength, -int64(len(msgs)))
+	c.wg.Add(1)
+	flushed := c.flushed
+	if flushed != nil {
+		flushed.Add(1)
+	}
+	go func() {
+		err := c.send(c.ctx, endpoint, msgs)
+		if err != nil {
+			c.log("error", map[string]interface{}{"batch_size": len(msgs)}, "%s", err)
+		}
+		c.upmtx.Lock()
+		c.upcount--
+		c.upcond.Signal()
+		c.upmtx.Unlock()
+		c.wg.Done()
+		if flushed != nil {
+			flushed.Done()
+		}
+	}()
+}
+
+// Send batch request with the DefaultContext.
+func (c *Client) send(ctx context.Context, endpoint string, msgs []interface{}) error {
+	return c.sendBatch(ctx, endpoint, DefaultContext, msgs)
+}
+
+// Send batch request, reporting the outcome to the callback. Batches over
+// the size limit of the API are split in halves that are sent separately.
+// Retries are given up on once ctx is done.
+func (c *Client) sendBatch(ctx context.Context, endpoint string, batchContext map[string]interface{}, msgs []interface{}) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	batch := new(Batch)
+	batch.Messages = msgs
+	batch.MessageId = c.uid()
+	batch.SentAt = timestamp(c.sentAt())
+	batch.Context = batchContext
+	if !c.Historical && !c.FreezeTimestampAtEnqueue {
+		for _, msg := range msgs {
+			if m, ok := msg.(message); ok {
+				m.setTimestamp(batch.SentAt)
+			}
+		}
+	}
+
+	body, err := c.newBatchBody(batch)
+	if err != nil {
+		return c.fail(msgs, fmt.Errorf("error marshalling msgs: %s", err))
+	}
+
+	if body.size > maxBatchBytes {
+		if len(msgs) == 1 {
+			return c.fail(msgs, fmt.Errorf("msg of %d bytes exceeds the %d bytes batch limit", body.size, maxBatchBytes))
+		}
+		c.verbose("batch of %d bytes exceeds %d bytes – splitting", body.size, maxBatchBytes)
+		half := len(msgs) / 2
+		err := c.sendBatch(ctx, endpoint, batchContext, msgs[:half])
+		if e := c.sendBatch(ctx, endpoint, batchContext, msgs[half:]); e != nil {
+			err = e
+		}
+		return err
+	}
+
+	if c.Idempotent {
+		body.idempotencyKey = idempotencyKey(batch)
+	}
+	if c.Gzip && !c.DryRun {
+		if err := body.compress(); err != nil {
+			c.logf("error compressing msgs, sending them uncompressed: %s", err)
+		}
+	}
+
+	retries := c.MaxRetries
+	if retries <= 0 {
+		retries = 9
+	}
+
+	atomic.AddInt64(&c.stats.MessagesInFlight, int64(len(msgs)))
+	defer atomic.AddInt64(&c.stats.MessagesInFlight, -int64(len(msgs)))
+
+	i := 0
+	if c.TraceBatch != nil {
+		var end func(int, error)
+		traced := ctx
+		if !c.protect(func() { traced, end = c.TraceBatch(ctx, len(msgs), body.size) }) && end != nil {
+			ctx = traced
+			defer func() { c.protect(func() { end(i, err) }) }()
+		}
+	}
+
+	start := c.clock().Now()
+	for ; ; i++ {
+		if err = c.upload(ctx, endpoint, body); err == nil {
+			errs := partialErrors(body.results, len(msgs))
+			rejected := 0
+			for _, e := range errs {
+				if e != nil {
+					rejected++
+				}
+			}
+			atomic.AddInt64(&c.stats.MessagesSent, int64(len(msgs)-rejected))
+			atomic.AddInt64(&c.stats.MessagesDropped, int64(rejected))
+			atomic.AddInt64(&c.stats.BatchesSent, 1)
+			if body.gzipped {
+				atomic.AddInt64(&c.stats.UncompressedBytes, int64(body.size))
+				atomic.AddInt64(&c.stats.CompressedBytes, body.compressedSize())
+			}
+			if callback, ok := c.Callback.(BatchCallback); ok {
+				c.protect(func() { callback.BatchSuccess(len(msgs), body.size, c.clock().Now().Sub(start)) })
+			}
+			if callback, ok := c.Callback.(RetryCallback); ok {
+				c.protect(func() { callback.SuccessAfter(i + 1) })
+			}
+			c.uploadFailing(nil)
+			if errs == nil {
+				c.report(msgs, nil)
+				return nil
+			}
+			for i, msg := range msgs {
+				c.report([]interface{}{msg}, errs[i])
+			}
+			return nil
+		}
+		retry := c.retryable(err)
+		if _, ok := err.(*APIError); !ok {
+			err = &SendError{Endpoint: endpoint, Err: err}
+		}
+		if !retry {
+			break
+		}
+		if i == retries {
+			err = &RetryExhaustedError{Attempts: i + 1, Err: err}
+			break
+		}
+		delay := c.retryAfter(i)
+		if e, ok := err.(*APIError); ok && e.RetryAfter > delay {
+			delay = e.RetryAfter
+		}
+		if c.Verbose {
+			c.log("debug", map[string]interface{}{
+				"batch_size": len(msgs),
+				"retry":      i + 1,
+				"delay":      delay.String(),
+			}, "retrying %d msgs in %s – %s", len(msgs), delay, err)
+		}
+		evicted, done := c.awaitRetry()
+		select {
+		case <-c.clock().After(delay):
+			done()
+		case <-evicted:
+			c.verbose("too many batches retrying – giving up on %d msgs", len(msgs))
+			c.uploadFailing(err)
+			return c.fail(msgs, err)
+		case <-ctx.Done():
+			done()
+			c.uploadFailing(err)
+			return c.fail(msgs, err)
+		}
+		atomic.AddInt64(&c.stats.RetriesTotal, 1)
+		if callback, ok := c.Callback.(RetryCallback); ok {
+			c.protect(func() { callback.Retry(i+1, err) })
+		}
+	}
+
+	c.uploadFailing(err)
+	return c.fail(msgs, err)
+}
+
+// Return the idempotency key of batch: a hash of the sorted ids of its
+// messages, or its own id if some of them have none.
+func idempotencyKey(batch *Batch) string {
+	ids := make([]string, 0, len(batch.Messages))
+	for _, msg := range batch.Messages {
+		m, ok := msg.(message)
+		if !ok || m.id() == "" {
+			return batch.MessageId
+		}
+		ids = append(ids, m.id())
+	}
+	sort.Strings(ids)
+
+	h := sha256.New()
+	for _, id := range ids {
+		h.Write([]byte(id))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Return how long to wait before retrying a failed upload attempt.
+func (c *Client) retryAfter(attempt int) time.Duration {
+	if c.RetryAfter != nil {
+		var d time.Duration
+		if !c.protect(func() { d = c.RetryAfter(attempt) }) {
+			return d
+		}
+	}
+	return Backo.Duration(attempt)
+}
+
+// Take one of the MaxConcurrentRetries slots of the batches waiting to be
+// retried, evicting the batch holding the oldest one if they are all taken.
+// The returned channel is closed if the batch is evicted in turn, otherwise
+// done must be called once it is retried.
+func (c *Client) awaitRetry() (evicted <-chan struct{}, done func()) {
+	if c.MaxConcurrentRetries <= 0 {
+		return nil, func() {}
+	}
+
+	slot := make(chan struct{})
+	c.retrymtx.Lock()
+	defer c.retrymtx.Unlock()
+	for len(c.retrying) >= c.MaxConcurrentRetries {
+		close(c.retrying[0])
+		c.retrying = c.retrying[1:]
+	}
+	c.retrying = append(c.retrying, slot)
+
+	return slot, func() {
+		c.retrymtx.Lock()
+		defer c.retrymtx.Unlock()
+		for i, s := range c.retrying {
+			if s == slot {
+				c.retrying = append(c.retrying[:i:i], c.retrying[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Give up on msgs, reporting err as their failure.
+func (c *Client) fail(msgs []interface{}, err error) error {
+	atomic.AddInt64(&c.stats.MessagesDropped, int64(len(msgs)))
+	c.report(msgs, err)
+	return err
+}
+
+// Report the outcome of sending msgs to the callback, in batch order.
+func (c *Client) report(msgs []interface{}, err error) {
+	c.unstore(msgs, err)
+	for _, msg := range msgs {
+		c.resolve(msg, err)
+	}
+	if c.Callback == nil {
+		return
+	}
+
+	// uploads aborted by the ShutdownTimeout are drops rather than failures.
+	shutdown := err != nil && c.ctx.Err() != nil
+	for _, msg := range msgs {
+		if shutdown && c.drop(msg, DropShutdown) {
+			continue
+		}
+		if err != nil {
+			c.protect(func() { c.Callback.Failure(msg, err) })
+		} else {
+			c.protect(func() { c.Callback.Success(msg) })
+		}
+	}
+}
+
+// Report msg as dropped for reason if the callback is a DropCallback,
+// returning whether it is.
+func (c *Client) drop(msg interface{}, reason DropReason) bool {
+	err := fmt.Errorf("%w: %s", ErrDropped, reason)
+	if reason == DropQueueFull {
+		err = fmt.Errorf("%w: %w", ErrDropped, ErrQueueFull)
+	}
+	c.resolve(msg, err)
+	callback, ok := c.Callback.(DropCallback)
+	if ok {
+		c.protect(func() { callback.Drop(msg, reason) })
+	}
+	return ok
+}
+
+// Send the outcome of msg to EnqueueAwait, if it is awaited, and to its
+// callback from EnqueueWithCallback.
+func (c *Client) resolve(msg interface{}, err error) {
+	// only prepared messages are awaited, others may not even be hashable.
+	if _, ok := msg.(message); !ok {
+		return
+	}
+	if result, ok := c.awaiting.LoadAndDelete(msg); ok {
+		result.(chan error) <- err
+	}
+	if callback, ok := c.callbacks.LoadAndDelete(msg); ok {
+		held := callback.(*heldCallback)
+		if err != nil {
+			held.report(c, func() { held.Failure(msg, err) })
+		} else {
+			held.report(c, func() { held.Success(msg) })
+		}
+	}
+}
+
+// Upload batch body to endpoint.
+func (c *Client) upload(ctx context.Context, endpoint string, batch *batchBody) error {
+	if c.DryRun {
+		return c.dryRun(endpoint, batch)
+	}
+	if resumed := c.resumed(); resumed != nil {
+		select {
+		case <-resumed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if c.MaxRequestsPerSecond > 0 {
+		if err := c.limiter.wait(ctx, c.MaxRequestsPerSecond); err != nil {
+			return err
+		}
+	}
+	if c.FlushTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.FlushTimeout)
+		defer cancel()
+	}
+	if c.StreamTransport != nil {
+		err := c.stream(ctx, batch)
+		if err == nil {
+			return nil
+		}
+		c.verbose("error streaming batch, falling back to http: %s", err)
+	}
+
+	method := c.HTTPMethod
+	if method == "" {
+		method = "POST"
+	}
+	req, err := http.NewRequest(method, endpoint+c.batchPath(), nil)
+	if err != nil {
+		return fmt.Errorf("error creating request: %s", err)
+	}
+	req = req.WithContext(ctx)
+
+	for key, values := range c.Headers {
+		switch http.CanonicalHeaderKey(key) {
+		case "Authorization", "Content-Type", "Content-Encoding":
+			continue
+		}
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+
+	req.Header.Set("User-Agent", c.userAgent())
+	contentType := c.Encoding.contentType()
+	if batch.contentType != "" {
+		contentType = batch.contentType
+	}
+	if c.ContentType != "" {
+		contentType = c.ContentType
+	}
+	req.Header.Set("Content-Type", contentType)
+	if batch.gzipped {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if batch.idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", batch.idempotencyKey)
+	}
+	key := c.key
+	if c.WriteKeyFunc != nil {
+		rotated := key
+		if !c.protect(func() { rotated = c.WriteKeyFunc() }) {
+			key = rotated
+		}
+	}
+	req.SetBasicAuth(key, "")
+
+	if err := batch.attach(req); err != nil {
+		return fmt.Errorf("error opening batch: %s", err)
+	}
+	if c.OnRequest != nil {
+		hooked := req.Clone(ctx)
+		hooked.Body, hooked.GetBody = http.NoBody, nil
+		c.protect(func() { c.OnRequest(hooked) })
+	}
+	res, err := c.httpClient().Do(req)
+	req.Body.Close()
+	batch.wait()
+	if c.OnResponse != nil {
+		c.onResponse(res, err)
+	}
+	if c.CorrectClockSkew && err == nil {
+		c.learnSkew(res.Header.Get("Date"))
+	}
+	if err != nil {
+		return fmt.Errorf("error sending request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 400 {
+		if c.PartialFailureSupport {
+			body, err := ioutil.ReadAll(res.Body)
+			if err == nil {
+				batch.results = parseResults(body)
+			}
+			c.verbose("response %s – %s", res.Status, truncate(body))
+		} else if c.Verbose {
+			body, _ := ioutil.ReadAll(io.LimitReader(res.Body, maxLoggedBody+1))
+			c.log("debug", map[string]interface{}{"status": res.StatusCode}, "response %s – %s", res.Status, truncate(body))
+		}
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("error reading response body: %w", err)
+	}
+	if c.Verbose {
+		c.log("debug", map[string]interface{}{"status": res.StatusCode}, "response %s – %s", res.Status, truncate(body))
+	}
+
+	retry := isRetryable(nil, res.StatusCode)
+	if c.ShouldRetry != nil {
+		res.Body = ioutil.NopCloser(bytes.NewReader(body))
+		decided := retry
+		if !c.protect(func() { decided = c.ShouldRetry(res, nil) }) {
+			retry = decided
+		}
+	}
+
+	return &APIError{
+		StatusCode: res.StatusCode,
+		Body:       string(body),
+		Retryable:  retry,
+		RetryAfter: c.parseRetryAfter(res.Header.Get("Retry-After")),
+	}
+}
+
+// Write batch for DryRun rather than uploading it to endpoint.
+func (c *Client) dryRun(endpoint string, batch *batchBody) error {
+	b, err := json.MarshalIndent(batch.batch, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling msgs: %s", err)
+	}
+	if c.DryRunOutput == nil {
+		c.log("info", map[string]interface{}{"batch_size": len(batch.batch.Messages)}, "dry run – batch for %s:\n%s", endpoint, b)
+		return nil
+	}
+	if _, err := fmt.Fprintf(c.DryRunOutput, "%s\n", b); err != nil {
+		return fmt.Errorf("error writing dry run batch: %s", err)
+	}
+	return nil
+}
+
+// Send batch body with the StreamTransport.
+func (c *Client) stream(ctx context.Context, batch *batchBody) error {
+	r, err := batch.open()
+	if err != nil {
+		return fmt.Errorf("error opening batch: %s", err)
+	}
+	if c.protect(func() { err = c.StreamTransport.Send(ctx, r) }) {
+		err = errors.New("stream transport panicked")
+	}
+	r.Close()
+	batch.wait()
+	return err
+}
+
+// Outcome of a message in the response to a partially accepted batch.
+type partialResult struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+// Parse the results of a response body, returning nil if it has none.
+func parseResults(body []byte) []partialResult {
+	var res struct {
+		Results []partialResult `json:"results"`
+	}
+	if err := json.Unmarshal(body, &res); err != nil {
+		return nil
+	}
+	return res.Results
+}
+
+// Return the errors of the n messages of a batch given their results, or nil
+// if there isn't a result for each of them.
+func partialErrors(results []partialResult, n int) []error {
+	if len(results) == 0 || len(results) != n {
+		return nil
+	}
+
+	errs := make([]error, n)
+	for i, r := range results {
+		if r.Status >= 400 {
+			errs[i] = &APIError{StatusCode: r.Status, Body: r.Message}
+		}
+	}
+	return errs
+}
+
+// Parse the value of a Retry-After header, either delay seconds or an HTTP
+// date, returning 0 if it is missing or invalid.
+func (c *Client) parseRetryAfter(s string) time.Duration {
+	if s == "" {
+		return 0
+	}
+	if n, err := strconv.Atoi(s); err == nil {
+		if n < 0 {
+			return 0
+		}
+		return time.Duration(n) * time.Second
+	}
+	if t, err := http.ParseTime(s); err == nil {
+		if d := t.Sub(c.now()); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// Return the User-Agent header of requests.
+func (c *Client) userAgent() string {
+	if c.UserAgent != "" {
+		return c.UserAgent
+	}
+	return "analytics-go (version: " + Version + ")"
+}
+
+// Return the http client used for uploads.
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	if c.Client.Transport != nil || (c.MaxIdleConns <= 0 && c.IdleConnTimeout <= 0) {
+		return &c.Client
+	}
+
+	c.pooledOnce.Do(func() {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		if c.MaxIdleConns > 0 {
+			transport.MaxIdleConns = c.MaxIdleConns
+			transport.MaxIdleConnsPerHost = c.MaxIdleConns
+		}
+		if c.IdleConnTimeout > 0 {
+			transport.IdleConnTimeout = c.IdleConnTimeout
+		}
+		c.pooled = c.Client
+		c.pooled.Transport = transport
+	})
+	return &c.pooled
+}
+
+// Report whether an upload failing with err may succeed when retried.
+func (c *Client) retryable(err error) bool {
+	var exhausted *RetryExhaustedError
+	if errors.As(err, &exhausted) {
+		err = exhausted.Err
+	}
+	var send *SendError
+	if errors.As(err, &send) {
+		err = send.Err
+	}
+	if e, ok := err.(*APIError); ok {
+		return e.Retryable
+	}
+	if c.ShouldRetry != nil {
+		var retry bool
+		if !c.protect(func() { retry = c.ShouldRetry(nil, err) }) {
+			return retry
+		}
+	}
+	return isRetryable(err, 0)
+}
+
+// Report whether a request may succeed when retried, given the status code
+// of its response or, when there is none, the error it failed with. Server
+// errors and rate limiting are retried, other responses are not. Timeouts,
+// refused or reset connections, unexpected EOFs and temporary DNS failures
+// are retried, as are the other network errors, while cancellation and
+// errors unrelated to the network, e.g. an invalid endpoint, are not.
+func isRetryable(err error, statusCode int) bool {
+	if statusCode != 0 {
+		return statusCode == http.StatusTooManyRequests || statusCode >= 500
+	}
+
+	switch {
+	case err == nil, errors.Is(err, context.Canceled):
+		return false
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.EPIPE):
+		return true
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTimeout || dnsErr.IsTemporary
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr)
+}
+
+// Key of the messages batched together: the endpoint they are uploaded to,
+// their type with HomogeneousBatches, and whether they are PriorityHigh.
+type batchKey struct {
+	endpoint string
+	typ      string
+	urgent   bool
+}
+
+// Messages buffered by the loop for a batch.
+type pending struct {
+	msgs []interface{}
+	// serialized size of msgs, only tracked when MaxBatchBytes is set.
+	size int
+	// since is when the first message was buffered.
+	since time.Time
+}
+
+// Batch loop.
+func (c *Client) loop(tick Ticker) {
+	// buffered messages by the batch they go in.
+	msgs := make(map[batchKey]*pending)
+	// aged fires at the deadline of the oldest batch, with MaxMessageAge.
+	var aged <-chan time.Time
+	var deadline time.Time
+
+	for {
+		// stop taking messages from the queues while paused.
+		queue, urgent, low, resumed := c.msgs, c.urgent, c.low, c.resumed()
+		if resumed != nil {
+			queue, urgent, low = nil, nil, nil
+		}
+
+		if next := c.nextDeadline(msgs); !next.Equal(deadline) {
+			deadline, aged = next, nil
+			if !next.IsZero() {
+				aged = c.clock().After(next.Sub(c.clock().Now()))
+			}
+		}
+
+		// take urgent messages first.
+		select {
+		case msg := <-urgent:
+			c.buffer(msgs, msg, true)
+			continue
+		default:
+		}
+
+		select {
+		case msg := <-urgent:
+			c.buffer(msgs, msg, true)
+		case msg := <-queue:
+			c.buffer(msgs, msg, false)
+		case msg := <-low:
+			c.buffer(msgs, msg, false)
+		case <-resumed:
+			c.verbose("resumed")
+			deadline = time.Time{}
+		case set := <-c.settings:
+			set(&tick)
+		case taken := <-c.take:
+			taken <- c.takeAll(msgs)
+		case done := <-c.flush:
+			c.verbose("flush requested – draining msgs")
+			flushed := new(sync.WaitGroup)
+			c.flushed = flushed
+			// only drain what is already queued, don't wait for more.
+			for n := len(c.urgent); n > 0; n-- {
+				c.buffer(msgs, <-c.urgent, true)
+			}
+			for _, queue := range []chan message{c.msgs, c.low} {
+				for n := len(queue); n > 0; n-- {
+					c.buffer(msgs, <-queue, false)
+				}
+			}
+			c.verbose("flush requested – flushing %d", c.sendAll(msgs))
+			c.flushed = nil
+			// wait for the batches of the flush only, and apart from the loop
+			// so that messages keep being batched in the meantime.
+			go func() {
+				flushed.Wait()
+				close(done)
+			}()
+		case <-aged:
+			// wait for another deadline, or for uploads to be resumed.
+			aged = nil
+			if resumed != nil {
+				c.verbose("max message age reached – paused")
+			} else {
+				c.verbose("max message age reached – flushing %d", c.sendAged(msgs))
+			}
+		case <-tick.C():
+			if resumed != nil {
+				c.verbose("interval reached – paused")
+			} else if len(msgs) > 0 {
+				c.verbose("interval reached - flushing %d", c.sendAll(msgs))
+			} else {
+				c.verbose("interval reached – nothing to send")
+			}
+		case <-c.quit:
+			tick.Stop()
+			c.verbose("exit requested – draining msgs")
+			// drain the msg channels, all at once as they are closed together
+			// once no more messages are being enqueued.
+			queue, urgent, low := c.msgs, c.urgent, c.low
+			for queue != nil || urgent != nil || low != nil {
+				select {
+				case msg, ok := <-urgent:
+					if !ok {
+						urgent = nil
+						continue
+					}
+					c.buffer(msgs, msg, true)
+				case msg, ok := <-queue:
+					if !ok {
+						queue = nil
+						continue
+					}
+					c.buffer(msgs, msg, false)
+				case msg, ok := <-low:
+					if !ok {
+						low = nil
+						continue
+					}
+					c.buffer(msgs, msg, false)
+				}
+			}
+			c.verbose("exit requested – flushing %d", c.sendAll(msgs))
+			c.wg.Wait()
+			c.verbose("exit")
+			close(c.shutdown)
+			return
+		}
+	}
+}
+
+// Buffer msg, sending the messages buffered for its batch once the Size
+// or MaxBatchBytes limit is reached.
+func (c *Client) buffer(msgs map[batchKey]*pending, msg message, urgent bool) {
+	c.dequeued(msg)
+	key := batchKey{endpoint: c.endpoint(msg), urgent: urgent}
+	if c.HomogeneousBatches {
+		key.typ = msg.typ()
+	}
+
+	size := 0
+	if c.MaxBatchBytes > 0 {
+		b, err := json.Marshal(msg)
+		if err != nil {
+			c.reject(msg, fmt.Errorf("error marshalling msg: %s", err))
+			return
+		}
+		// account for the separating comma.
+		size = len(b) + 1
+		if size > c.MaxBatchBytes {
+			c.reject(msg, fmt.Errorf("msg of %d bytes exceeds the %d bytes batch limit", size, c.MaxBatchBytes))
+			return
+		}
+		if p := msgs[key]; p != nil && p.size+size > c.MaxBatchBytes {
+			c.verbose("exceeded %d bytes – flushing", c.MaxBatchBytes)
+			c.sendAsync(key.endpoint, p.msgs)
+			delete(msgs, key)
+		}
+	}
+
+	p := msgs[key]
+	if p == nil {
+		p = &pending{msgs: make([]interface{}, 0, c.Size), since: c.clock().Now()}
+		msgs[key] = p
+	}
+
+	limit := c.batchSize()
+	c.verbose("buffer (%d/%d) %v", len(p.msgs), limit, msg)
+	p.msgs = append(p.msgs, msg)
+	p.size += size
+	if len(p.msgs) >= limit {
+		c.verbose("exceeded %d messages – flushing", limit)
+		c.sendAsync(key.endpoint, p.msgs)
+		delete(msgs, key)
+	}
+}
+
+// Send all buffered messages, returning how many there were.
+func (c *Client) sendAll(msgs map[batchKey]*pending) int {
+	n := 0
+	// send the batches of urgent messages first.
+	for _, urgent := range []bool{true, false} {
+		for key, p := range msgs {
+			if key.urgent != urgent {
+				continue
+			}
+			n += len(p.msgs)
+			c.sendAsync(key.endpoint, p.msgs)
+			delete(msgs, key)
+		}
+	}
+	return n
+}
+
+// Weight of every new message in the average gap between messages.
+const gapSmoothing = 0.1
+
+// Return the number of messages a batch is sent at: Size, or with
+// AdaptiveBatching the number of messages buffered in a second at the
+// average rate, updated with the message being buffered.
+func (c *Client) batchSize() int {
+	if !c.AdaptiveBatching {
+		return c.Size
+	}
+
+	now := c.clock().Now()
+	first := c.lastBuffered.IsZero()
+	if !first {
+		gap := now.Sub(c.lastBuffered)
+		if c.gap == 0 {
+			c.gap = gap
+		} else {
+			c.gap += time.Duration(gapSmoothing * float64(gap-c.gap))
+		}
+	}
+	c.lastBuffered = now
+
+	min, max := c.MinBatchSize, c.MaxBatchSize
+	if min <= 0 {
+		min = 1
+	}
+	if max <= 0 {
+		max = c.Size
+	}
+	switch {
+	case first:
+		return min
+	case c.gap <= 0:
+		return max
+	}
+	size := int(time.Second / c.gap)
+	if size < min {
+		size = min
+	}
+	if size > max {
+		size = max
+	}
+	return size
+}
+
+// Return the time the oldest batch in msgs reaches the MaxMessageAge, or the
+// zero time if there is none.
+func (c *Client) nextDeadline(msgs map[batchKey]*pending) time.Time {
+	var next time.Time
+	if c.MaxMessageAge <= 0 {
+		return next
+	}
+	for _, p := range msgs {
+		if next.IsZero() || p.since.Before(next) {
+			next = p.since
+		}
+	}
+	if next.IsZero() {
+		return next
+	}
+	return next.Add(c.MaxMessageAge)
+}
+
+// Send the batches of msgs whose oldest message reached the MaxMessageAge,
+// returning the number of messages sent.
+func (c *Client) sendAged(msgs map[batchKey]*pending) int {
+	n := 0
+	now := c.clock().Now()
+	for key, p := range msgs {
+		if now.Sub(p.since) < c.MaxMessageAge {
+			continue
+		}
+		n += len(p.msgs)
+		c.sendAsync(key.endpoint, p.msgs)
+		delete(msgs, key)
+	}
+	return n
+}
+
+// Drop queued msg without uploading it, reporting err as its failure.
+func (c *Client) reject(msg message, err error) {
+	c.logf("%s", err)
+	atomic.AddInt64(&c.stats.QueueLength, -1)
+	c.fail([]interface{}{msg}, err)
+}
+
+// Return the endpoint msg is uploaded to.
+func (c *Client) endpoint(msg message) string {
+	return c.typeEndpoint(msg.typ())
+}
+
+// Return the endpoint the messages of type typ are uploaded to.
+func (c *Client) typeEndpoint(typ string) string {
+	if endpoint, ok := c.Endpoints[typ]; ok {
+		return endpoint
+	}
+	return c.defaultEndpoint()
+}
+
+// Weight of every new sample in the estimate of the clock skew.
+const skewSmoothing = 0.2
+
+// Update the estimate of the clock skew with the Date of a response, whose
+// precision is a second, through an exponential moving average.
+func (c *Client) learnSkew(date string) {
+	t, err := http.ParseTime(date)
+	if err != nil {
+		return
+	}
+	// the date is truncated to the second, take the middle of it.
+	sample := t.Add(500 * time.Millisecond).Sub(c.now())
+
+	c.skewmtx.Lock()
+	defer c.skewmtx.Unlock()
+	if !c.skewKnown {
+		c.skew, c.skewKnown = sample, true
+	} else {
+		c.skew += time.Duration(skewSmoothing * float64(sample-c.skew))
+	}
+	c.verbose("clock skew estimated at %s", c.skew)
+}
+
+// Return the time a batch is sent at, corrected with CorrectClockSkew.
+func (c *Client) sentAt() time.Time {
+	now := c.now()
+	if !c.CorrectClockSkew {
+		return now
+	}
+	c.skewmtx.Lock()
+	defer c.skewmtx.Unlock()
+	return now.Add(c.skew)
+}
+
+// Return the path batches are uploaded to.
+func (c *Client) batchPath() string {
+	switch {
+	case c.BatchPath != "":
+		return c.BatchPath
+	case c.Historical:
+		return "/v1/import"
+	}
+	return "/v1/batch"
+}
+
+// Call OnResponse with a copy of res without its Body.
+func (c *Client) onResponse(res *http.Response, err error) {
+	if res != nil {
+		hooked := *res
+		hooked.Body = http.NoBody
+		res = &hooked
+	}
+	c.protect(func() { c.OnResponse(res, err) })
+}
+
+// Call f, a hook supplied by the user, recovering from its panics, which are
+// passed to OnPanic or logged. Return whether it panicked.
+func (c *Client) protect(f func()) (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicked = true
+			if c.OnPanic != nil {
+				c.OnPanic(r)
+			} else {
+				c.logf("recovered from panic: %v\n%s", r, debug.Stack())
+			}
+		}
+	}()
+	f()
+	return false
+}
+
+// Return Endpoint, or that of the Region if Endpoint is the default.
+func (c *Client) defaultEndpoint() string {
+	if endpoint, ok := regionEndpoints[c.Region]; ok && c.Endpoint == Endpoint {
+		return endpoint
+	}
+	return c.Endpoint
+}
+
+// Return the Clock, or the real one by default.
+func (c *Client) clock() Clock {
+	if c.Clock != nil {
+		return c.Clock
+	}
+	return realClock{}
+}
+
+// Verbose log.
+func (c *Client) verbose(msg string, args ...interface{}) {
+	if c.Verbose {
+		c.log("debug", nil, msg, args...)
 	}
 }
 
-// Unconditional log.
 func (c *Client) logf(msg string, args ...interface{}) {
+	c.log("error", nil, msg, args...)
+}
+
+// Log msg formatted with args, passing fields to the StructuredLogger if
+// there is one.
+func (c *Client) log(level string, fields map[string]interface{}, msg string, args ...interface{}) {
+	if c.StructuredLogger != nil {
+		c.StructuredLogger.Log(level, fmt.Sprintf(msg, args...), fields)
+		return
+	}
 	c.Logger.Printf(msg, args...)
 }
 
+// Validate "alias" message and set its type.
+func (msg *Alias) validate() error {
+	if msg.UserId == "" {
+		return &FieldError{Field: "userId", Reason: "You must pass a 'userId'."}
+	}
+
+	if msg.PreviousId == "" {
+		return &FieldError{Field: "previousId", Reason: "You must pass a 'previousId'."}
+	}
+
+	msg.Type = "alias"
+	return nil
+}
+
+// Validate "page" message and set its type. The name is optional.
+func (msg *Page) validate() error {
+	if msg.UserId == "" && msg.AnonymousId == "" {
+		return errMissingIdentity
+	}
+
+	msg.Type = "page"
+	return nil
+}
+
+// Validate "screen" message and set its type. Unlike pages, screens must be
+// named.
+func (msg *Screen) validate() error {
+	if msg.Name == "" {
+		return &FieldError{Field: "name", Reason: "You must pass a 'name'."}
+	}
+
+	if msg.UserId == "" && msg.AnonymousId == "" {
+		return errMissingIdentity
+	}
+
+	msg.Type = "screen"
+	return nil
+}
+
+// Error of messages without a userId or anonymousId.
+var errMissingIdentity = &FieldError{Field: "userId", Reason: "You must pass either an 'anonymousId' or 'userId'."}
+
+// Validate "group" message and set its type.
+func (msg *Group) validate() error {
+	if msg.GroupId == "" {
+		return &FieldError{Field: "groupId", Reason: "You must pass a 'groupId'."}
+	}
+
+	if msg.UserId == "" && msg.AnonymousId == "" {
+		return errMissingIdentity
+	}
+
+	msg.Type = "group"
+	return nil
+}
+
+// Validate "identify" message and set its type.
+func (msg *Identify) validate() error {
+	if msg.UserId == "" && msg.AnonymousId == "" {
+		return errMissingIdentity
+	}
+
+	msg.Type = "identify"
+	return nil
+}
+
+// Validate "track" message and set its type.
+func (msg *Track) validate() error {
+	if msg.Event == "" {
+		return &FieldError{Field: "event", Reason: "You must pass 'event'."}
+	}
+
+	if msg.UserId == "" && msg.AnonymousId == "" {
+		return errMissingIdentity
+	}
+
+	msg.Type = "track"
+	return nil
+}
+
 // Set message timestamp if one is not already set.
 func (m *Message) setTimestamp(s string) {
 	if m.Timestamp == "" {
@@ -391,6 +3636,45 @@ func (m *Message) setTimestamp(s string) {
 	}
 }
 
+// Return pointers to the message contexts.
+func (msg *Alias) contextMap() *map[string]interface{}    { return &msg.Context }
+func (msg *Page) contextMap() *map[string]interface{}     { return &msg.Context }
+func (msg *Screen) contextMap() *map[string]interface{}   { return &msg.Context }
+func (msg *Group) contextMap() *map[string]interface{}    { return &msg.Context }
+func (msg *Identify) contextMap() *map[string]interface{} { return &msg.Context }
+func (msg *Track) contextMap() *map[string]interface{}    { return &msg.Context }
+
+// Return pointers to the message properties or traits, nil for aliases.
+func (msg *Alias) propertiesMap() *map[string]interface{}    { return nil }
+func (msg *Page) propertiesMap() *map[string]interface{}     { return &msg.Traits }
+func (msg *Screen) propertiesMap() *map[string]interface{}   { return &msg.Properties }
+func (msg *Group) propertiesMap() *map[string]interface{}    { return &msg.Traits }
+func (msg *Identify) propertiesMap() *map[string]interface{} { return &msg.Traits }
+func (msg *Track) propertiesMap() *map[string]interface{}    { return &msg.Properties }
+
+// Return pointers to the message integrations.
+func (msg *Alias) integrationsMap() *map[string]interface{}    { return &msg.Integrations }
+func (msg *Page) integrationsMap() *map[string]interface{}     { return &msg.Integrations }
+func (msg *Screen) integrationsMap() *map[string]interface{}   { return &msg.Integrations }
+func (msg *Group) integrationsMap() *map[string]interface{}    { return &msg.Integrations }
+func (msg *Identify) integrationsMap() *map[string]interface{} { return &msg.Integrations }
+func (msg *Track) integrationsMap() *map[string]interface{}    { return &msg.Integrations }
+
+// Return message type.
+func (m *Message) typ() string {
+	return m.Type
+}
+
+// Return message id.
+func (m *Message) id() string {
+	return m.MessageId
+}
+
+// Return message timestamp.
+func (m *Message) eventTime() string {
+	return m.Timestamp
+}
+
 // Set message id.
 func (m *Message) setMessageId(s string) {
 	if m.MessageId == "" {
@@ -398,12 +3682,48 @@ func (m *Message) setMessageId(s string) {
 	}
 }
 
+// Return body for logging, truncated to maxLoggedBody.
+func truncate(body []byte) string {
+	if len(body) > maxLoggedBody {
+		return string(body[:maxLoggedBody]) + "…"
+	}
+	return string(body)
+}
+
 // Return formatted timestamp.
 func timestamp(t time.Time) string {
 	return strftime.Format("%Y-%m-%dT%H:%M:%S%z", t)
 }
 
-// Return uuid string.
-func uid() string {
-	return uuid.NewRandom().String()
+// Return gzip compressed b.
+func compress(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Return uuid string, read from Rand when it is set.
+func (c *Client) randomUid() string {
+	if c.Rand == nil {
+		return uuid.NewRandom().String()
+	}
+
+	var u uuid.UUID
+	c.randmtx.Lock()
+	_, err := io.ReadFull(c.Rand, u[:])
+	c.randmtx.Unlock()
+	if err != nil {
+		c.logf("error reading random id, using crypto/rand: %s", err)
+		return uuid.NewRandom().String()
+	}
+
+	u[6] = u[6]&0x0f | 0x40 // version 4
+	u[8] = u[8]&0x3f | 0x80 // IETF variant
+	return u.String()
 }
@@ -1,13 +1,30 @@
 package analytics
 
 import "net/http/httptest"
+import "context"
+import "compress/gzip"
 import "encoding/json"
 import "net/http"
 import "testing"
+import "sync"
+import "sync/atomic"
+import "math/rand"
 import "bytes"
 import "time"
 import "fmt"
 import "io"
+import "log"
+import "io/ioutil"
+import "reflect"
+import "sort"
+import "strconv"
+import "strings"
+import "errors"
+import "os"
+import "runtime"
+import "net"
+import "net/url"
+import "syscall"
 
 func mockId() string { return "I'm unique" }
 
@@ -40,6 +57,21 @@ func mockServer() (chan []byte, *httptest.Server) {
 	return done, server
 }
 
+// Return a client whose uploads are paused, so that the messages it accepts
+// stay in its queue of size messages until taken off it with queued.
+func pausedClient(size int) *Client {
+	client := New("h97jamjwbh")
+	client.MaxQueueSize = size
+	client.Pause()
+	return client
+}
+
+// Take the messages queued by client off its queue, in order.
+func queued(client *Client) []interface{} {
+	msgs, _ := client.takeQueued()
+	return msgs
+}
+
 func ExampleTrack() {
 	body, server := mockServer()
 	defer server.Close()
@@ -65,6 +97,12 @@ func ExampleTrack() {
 	// {
 	//   "batch": [
 	//     {
+	//       "context": {
+	//         "library": {
+	//           "name": "analytics-go",
+	//           "version": "2.1.0"
+	//         }
+	//       },
 	//       "event": "Download",
 	//       "messageId": "I'm unique",
 	//       "properties": {
@@ -114,6 +152,12 @@ func ExampleClose() {
 	// {
 	//   "batch": [
 	//     {
+	//       "context": {
+	//         "library": {
+	//           "name": "analytics-go",
+	//           "version": "2.1.0"
+	//         }
+	//       },
 	//       "event": "Download",
 	//       "messageId": "I'm unique",
 	//       "properties": {
@@ -162,6 +206,12 @@ func ExampleInterval() {
 	// {
 	//   "batch": [
 	//     {
+	//       "context": {
+	//         "library": {
+	//           "name": "analytics-go",
+	//           "version": "2.1.0"
+	//         }
+	//       },
 	//       "event": "Download",
 	//       "messageId": "I'm unique",
 	//       "properties": {
@@ -213,6 +263,12 @@ func ExampleTrackWithTimestampSet() {
 	// {
 	//   "batch": [
 	//     {
+	//       "context": {
+	//         "library": {
+	//           "name": "analytics-go",
+	//           "version": "2.1.0"
+	//         }
+	//       },
 	//       "event": "Download",
 	//       "messageId": "I'm unique",
 	//       "properties": {
@@ -264,6 +320,12 @@ func ExampleTrackWithMessageIdSet() {
 	// {
 	//   "batch": [
 	//     {
+	//       "context": {
+	//         "library": {
+	//           "name": "analytics-go",
+	//           "version": "2.1.0"
+	//         }
+	//       },
 	//       "event": "Download",
 	//       "messageId": "abc",
 	//       "properties": {
@@ -316,6 +378,10 @@ func ExampleTrack_context() {
 	//   "batch": [
 	//     {
 	//       "context": {
+	//         "library": {
+	//           "name": "analytics-go",
+	//           "version": "2.1.0"
+	//         },
 	//         "whatever": "here"
 	//       },
 	//       "event": "Download",
@@ -367,6 +433,12 @@ func ExampleTrack_many() {
 	// {
 	//   "batch": [
 	//     {
+	//       "context": {
+	//         "library": {
+	//           "name": "analytics-go",
+	//           "version": "2.1.0"
+	//         }
+	//       },
 	//       "event": "Download",
 	//       "messageId": "I'm unique",
 	//       "properties": {
@@ -378,6 +450,12 @@ func ExampleTrack_many() {
 	//       "userId": "123456"
 	//     },
 	//     {
+	//       "context": {
+	//         "library": {
+	//           "name": "analytics-go",
+	//           "version": "2.1.0"
+	//         }
+	//       },
 	//       "event": "Download",
 	//       "messageId": "I'm unique",
 	//       "properties": {
@@ -389,6 +467,12 @@ func ExampleTrack_many() {
 	//       "userId": "123456"
 	//     },
 	//     {
+	//       "context": {
+	//         "library": {
+	//           "name": "analytics-go",
+	//           "version": "2.1.0"
+	//         }
+	//       },
 	//       "event": "Download",
 	//       "messageId": "I'm unique",
 	//       "properties": {
@@ -441,6 +525,12 @@ func ExampleTrackWithIntegrations() {
 	// {
 	//   "batch": [
 	//     {
+	//       "context": {
+	//         "library": {
+	//           "name": "analytics-go",
+	//           "version": "2.1.0"
+	//         }
+	//       },
 	//       "event": "Download",
 	//       "integrations": {
 	//         "All": true,
@@ -476,3 +566,3572 @@ func TestCloseFinish(_ *testing.T) {
 	c := New("test")
 	c.Close()
 }
+
+func TestFlush(t *testing.T) {
+	body, server := mockServer()
+	defer server.Close()
+
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Interval = time.Hour
+	defer client.Close()
+
+	client.Track(&Track{
+		Event:  "Download",
+		UserId: "123456",
+	})
+
+	if err := client.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-body:
+	default:
+		t.Error("expected the queued message to be sent before Flush returned")
+	}
+}
+
+func TestFlushWhileEnqueueing(t *testing.T) {
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+	}))
+	defer server.Close()
+
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Interval = time.Hour
+	client.MaxQueueSize = 1
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+
+	flushed := make(chan error, 1)
+	go func() { flushed <- client.Flush() }()
+	<-started
+
+	// the loop keeps taking messages off the queue during the flush.
+	start := time.Now()
+	client.Track(&Track{Event: "Upload", UserId: "123456"})
+	client.Track(&Track{Event: "Share", UserId: "123456"})
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("expected enqueueing not to wait for the flush, took %s", d)
+	}
+	select {
+	case <-flushed:
+		t.Error("expected Flush to wait for the upload of its batch")
+	default:
+	}
+
+	close(release)
+	if err := <-flushed; err != nil {
+		t.Error(err)
+	}
+	client.Close()
+}
+
+// Callback flushing the client from Success, once.
+type flushingCallback struct {
+	callback
+	client  *Client
+	calls   int32
+	flushed chan error
+}
+
+func (c *flushingCallback) Success(msg interface{}) {
+	if atomic.AddInt32(&c.calls, 1) == 1 {
+		c.client.Track(&Track{Event: "Upload", UserId: "123456"})
+		c.flushed <- c.client.Flush()
+	}
+}
+
+func TestFlushFromCallback(t *testing.T) {
+	body, server := mockServer()
+	defer server.Close()
+
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Interval = time.Hour
+	cb := &flushingCallback{client: client, flushed: make(chan error, 1)}
+	client.Callback = cb
+	defer client.Close()
+
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+	go client.Flush()
+	<-body
+
+	select {
+	case <-body:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a Flush from the callback to send the message")
+	}
+	if err := <-cb.flushed; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEnqueueContextCancelled(t *testing.T) {
+	// nothing more will be accepted once the queue is full.
+	client := pausedClient(1)
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := client.EnqueueContext(ctx, &Track{Event: "Download", UserId: "123456"})
+	if err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestEnqueueUnsupportedType(t *testing.T) {
+	client := New("h97jamjwbh")
+	defer client.Close()
+
+	if err := client.Enqueue(Track{Event: "Download", UserId: "123456"}); err == nil {
+		t.Error("expected an error for a message passed by value")
+	}
+}
+
+func TestGzip(t *testing.T) {
+	done := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "gzip" {
+			t.Errorf("expected gzip Content-Encoding, got %q", r.Header.Get("Content-Encoding"))
+		}
+		z, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Error(err)
+			done <- ""
+			return
+		}
+		var v struct {
+			Batch []map[string]interface{} `json:"batch"`
+		}
+		if err := json.NewDecoder(z).Decode(&v); err != nil {
+			t.Error(err)
+		}
+		done <- fmt.Sprint(v.Batch[0]["event"])
+	}))
+	defer server.Close()
+
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Gzip = true
+	client.Size = 1
+
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+
+	if event := <-done; event != "Download" {
+		t.Errorf("expected event Download, got %q", event)
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestHTTPClient(t *testing.T) {
+	body, server := mockServer()
+	defer server.Close()
+
+	used := make(chan struct{}, 1)
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.HTTPClient = &http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			used <- struct{}{}
+			return http.DefaultTransport.RoundTrip(r)
+		}),
+	}
+
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+	client.Close()
+	<-body
+
+	select {
+	case <-used:
+	default:
+		t.Error("expected HTTPClient to be used for the upload")
+	}
+}
+
+func TestHTTPClientAndClient(t *testing.T) {
+	client := New("h97jamjwbh")
+	client.HTTPClient = &http.Client{}
+	client.Client.Timeout = time.Second
+
+	var configErr *ConfigError
+	err := client.Track(&Track{Event: "Download", UserId: "123456"})
+	if !errors.As(err, &configErr) || !strings.Contains(err.Error(), "HTTPClient") {
+		t.Errorf("expected setting both HTTPClient and Client to be rejected with a ConfigError, got %v", err)
+	}
+	if err := client.Track(&Track{Event: "Download", UserId: "123456"}); err == nil {
+		t.Error("expected the error to be returned every time")
+	}
+}
+
+func TestStats(t *testing.T) {
+	body, server := mockServer()
+	defer server.Close()
+
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Interval = time.Hour
+	defer client.Close()
+
+	for i := 0; i < 3; i++ {
+		client.Track(&Track{Event: "Download", UserId: "123456"})
+	}
+
+	if stats := client.Stats(); stats.QueueLength != 3 || stats.MessagesEnqueued != 3 {
+		t.Errorf("expected 3 queued messages, got %+v", stats)
+	}
+
+	client.Flush()
+	<-body
+
+	stats := client.Stats()
+	if stats.QueueLength != 0 || stats.MessagesInFlight != 0 || stats.MessagesSent != 3 || stats.BatchesSent != 1 {
+		t.Errorf("unexpected stats after flush: %+v", stats)
+	}
+}
+
+func TestCorrectClockSkew(t *testing.T) {
+	sentAt := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch struct{ SentAt string }
+		json.NewDecoder(r.Body).Decode(&batch)
+		sentAt <- batch.SentAt
+		w.Header().Set("Date", mockTime().Add(time.Hour).Format(http.TimeFormat))
+	}))
+	defer server.Close()
+
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.CorrectClockSkew = true
+	client.now = mockTime
+	defer client.Close()
+
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+	client.Flush()
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+	client.Flush()
+
+	if s := <-sentAt; s != "2009-11-10T23:00:00+0000" {
+		t.Errorf("expected the local time before any response, got %s", s)
+	}
+	if s := <-sentAt; s != "2009-11-11T00:00:00+0000" {
+		t.Errorf("expected the time of the server, got %s", s)
+	}
+}
+
+func TestWaitForEmpty(t *testing.T) {
+	body, server := mockServer()
+	defer server.Close()
+
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Interval = 50 * time.Millisecond
+	defer client.Close()
+
+	for i := 0; i < 3; i++ {
+		client.Track(&Track{Event: "Download", UserId: "123456"})
+	}
+	if err := client.WaitForEmpty(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if stats := client.Stats(); stats.MessagesSent != 3 {
+		t.Errorf("expected the messages to be sent, got %+v", stats)
+	}
+	<-body
+
+	client.SetInterval(time.Hour)
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := client.WaitForEmpty(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected the wait to time out, got %v", err)
+	}
+}
+
+func TestMaxMessageAge(t *testing.T) {
+	body, server := mockServer()
+	defer server.Close()
+
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Interval = time.Hour
+	client.MaxMessageAge = 50 * time.Millisecond
+	defer client.Close()
+
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+	select {
+	case b := <-body:
+		if !bytes.Contains(b, []byte("Download")) {
+			t.Errorf("unexpected batch %s", b)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected the message to be sent once it reached the MaxMessageAge")
+	}
+}
+
+func TestMultiClient(t *testing.T) {
+	oldBody, oldServer := mockServer()
+	defer oldServer.Close()
+	newBody, newServer := mockServer()
+	defer newServer.Close()
+
+	legacy, collector := New("h97jamjwbh"), New("h97jamjwbh")
+	legacy.Endpoint, collector.Endpoint = oldServer.URL, newServer.URL
+	client := MultiClient(legacy, collector)
+
+	if err := client.Track(&Track{Event: "Download", UserId: "123456"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []chan []byte{oldBody, newBody} {
+		if b := <-body; !bytes.Contains(b, []byte("Download")) {
+			t.Errorf("expected the message to be sent to both clients, got %s", b)
+		}
+	}
+
+	open := pausedClient(10)
+	client = MultiClient(legacy, open)
+	if err := client.Track(&Track{Event: "Download", UserId: "123456"}); err != nil {
+		t.Errorf("expected the message to be enqueued to one of the clients, got %v", err)
+	}
+	client.FailOnAny = true
+	if err := client.Track(&Track{Event: "Download", UserId: "123456"}); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected %v, got %v", ErrClosed, err)
+	}
+}
+
+func TestRequireTimestamp(t *testing.T) {
+	supplied := "2009-11-10T22:00:00+0000"
+	for _, freeze := range []bool{true, false} {
+		body, server := mockServer()
+
+		client := New("h97jamjwbh")
+		client.Endpoint = server.URL
+		client.FreezeTimestampAtEnqueue = freeze
+		client.now = mockTime
+		client.Track(&Track{Event: "Supplied", UserId: "123456", Message: Message{Timestamp: supplied}})
+		client.Track(&Track{Event: "Defaulted", UserId: "123456"})
+		client.Close()
+
+		var batch struct{ Batch []Track }
+		if err := json.Unmarshal(<-body, &batch); err != nil {
+			t.Fatal(err)
+		}
+		server.Close()
+		timestamps := map[string]string{}
+		for _, track := range batch.Batch {
+			timestamps[track.Event] = track.Timestamp
+		}
+		if timestamps["Supplied"] != supplied {
+			t.Errorf("expected the supplied timestamp to be kept, got %q", timestamps["Supplied"])
+		}
+		if timestamps["Defaulted"] != "2009-11-10T23:00:00+0000" {
+			t.Errorf("expected the timestamp to be defaulted, got %q", timestamps["Defaulted"])
+		}
+	}
+
+	client := pausedClient(10)
+	client.RequireTimestamp = true
+	if err := client.Track(&Track{Event: "Download", UserId: "123456"}); err == nil {
+		t.Error("expected a message without a timestamp to be rejected")
+	} else if e, ok := err.(*FieldError); !ok || e.Field != "timestamp" {
+		t.Errorf("expected a timestamp FieldError, got %v", err)
+	}
+	if err := client.Track(&Track{Event: "Download", UserId: "123456", Message: Message{Timestamp: supplied}}); err != nil {
+		t.Errorf("expected a message with a timestamp to be kept, got %v", err)
+	}
+}
+
+func TestCloseSummary(t *testing.T) {
+	body, server := mockServer()
+	defer server.Close()
+
+	var logs bytes.Buffer
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Logger = log.New(&logs, "", 0)
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+	client.Close()
+	<-body
+
+	if !strings.Contains(logs.String(), "sent 2 msgs in 1 batches, dropped 0 msgs, retried 0 times") {
+		t.Errorf("expected a summary of the stats, got %q", logs.String())
+	}
+}
+
+// Clock whose time only changes when set, with real tickers.
+type manualClock struct {
+	realClock
+	now time.Time
+}
+
+func (c *manualClock) Now() time.Time { return c.now }
+
+func TestAdaptiveBatching(t *testing.T) {
+	clock := &manualClock{now: mockTime()}
+	client := New("h97jamjwbh")
+	client.Clock = clock
+	client.AdaptiveBatching = true
+	client.MinBatchSize = 5
+	client.MaxBatchSize = 100
+
+	if size := client.batchSize(); size != 5 {
+		t.Errorf("expected the minimum size for the first message, got %d", size)
+	}
+	for i := 0; i < 50; i++ {
+		clock.now = clock.now.Add(time.Second)
+		client.batchSize()
+	}
+	if size := client.batchSize(); size != 5 {
+		t.Errorf("expected the minimum size at low traffic, got %d", size)
+	}
+	for i := 0; i < 100; i++ {
+		clock.now = clock.now.Add(20 * time.Millisecond)
+		client.batchSize()
+	}
+	if size := client.batchSize(); size < 45 || size > 55 {
+		t.Errorf("expected about 50 messages a second, got %d", size)
+	}
+	for i := 0; i < 100; i++ {
+		clock.now = clock.now.Add(time.Millisecond)
+		client.batchSize()
+	}
+	if size := client.batchSize(); size != 100 {
+		t.Errorf("expected the maximum size at high traffic, got %d", size)
+	}
+}
+
+func TestReset(t *testing.T) {
+	body, server := mockServer()
+	defer server.Close()
+
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Interval = time.Hour
+	client.Dedup = true
+	defer client.Close()
+
+	track := &Track{Event: "Download", UserId: "123456", Message: Message{MessageId: "abc"}}
+	client.Track(track)
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+
+	if err := client.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := client.Stats(); stats != (Stats{}) {
+		t.Errorf("expected stats to be zeroed, got %+v", stats)
+	}
+
+	if err := client.Track(track); err != nil {
+		t.Fatal(err)
+	}
+	client.Flush()
+
+	var batch struct{ Batch []map[string]interface{} }
+	if err := json.Unmarshal(<-body, &batch); err != nil {
+		t.Fatal(err)
+	}
+	if len(batch.Batch) != 1 || batch.Batch[0]["messageId"] != "abc" {
+		t.Errorf("expected only the message tracked after the reset, got %v", batch.Batch)
+	}
+}
+
+func TestExport(t *testing.T) {
+	body, server := mockServer()
+	defer server.Close()
+
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Interval = time.Hour
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+	client.Track(&Track{Event: "Upload", UserId: "123456"})
+
+	var b bytes.Buffer
+	if err := client.Export(&b); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"event":"Download"`) || !strings.Contains(lines[1], `"event":"Upload"`) {
+		t.Errorf("unexpected export %q", b.String())
+	}
+	if stats := client.Stats(); stats.QueueLength != 0 {
+		t.Errorf("expected the queue to be empty, got %+v", stats)
+	}
+
+	client.Close()
+	select {
+	case b := <-body:
+		t.Errorf("expected exported messages not to be sent, got %s", b)
+	default:
+	}
+	if err := client.Export(&b); err != nil {
+		t.Errorf("expected nothing to export once closed, got %v", err)
+	}
+}
+
+func TestOverflowPolicy(t *testing.T) {
+	track := &Track{Event: "Download", UserId: "123456"}
+
+	client := pausedClient(1)
+	client.OverflowPolicy = DropNewest
+
+	if err := client.Track(track); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Track(track); err != ErrQueueFull {
+		t.Errorf("expected ErrQueueFull, got %v", err)
+	}
+
+	client = pausedClient(1)
+	client.OverflowPolicy = DropOldest
+
+	client.Track(&Track{Event: "First", UserId: "123456"})
+	if err := client.Track(&Track{Event: "Second", UserId: "123456"}); err != nil {
+		t.Fatal(err)
+	}
+	if event := queued(client)[0].(*Track).Event; event != "Second" {
+		t.Errorf("expected the oldest message to be evicted, got %s", event)
+	}
+	if n := client.Stats().MessagesDropped; n != 1 {
+		t.Errorf("expected 1 dropped message, got %d", n)
+	}
+}
+
+func TestSync(t *testing.T) {
+	body, server := mockServer()
+	defer server.Close()
+
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Interval = time.Hour
+	client.Sync = true
+
+	if err := client.Track(&Track{Event: "Download", UserId: "123456"}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-body:
+	default:
+		t.Error("expected the message to be sent before Track returned")
+	}
+}
+
+func TestMaxRetries(t *testing.T) {
+	for _, test := range []struct {
+		status   int
+		attempts int
+	}{
+		{http.StatusBadRequest, 1},
+		{http.StatusTooManyRequests, 3},
+		{http.StatusInternalServerError, 3},
+	} {
+		attempts := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts++
+			w.WriteHeader(test.status)
+		}))
+
+		client := New("h97jamjwbh")
+		client.Endpoint = server.URL
+		client.MaxRetries = 2
+		client.Track(&Track{Event: "Download", UserId: "123456"})
+		client.Close()
+		server.Close()
+
+		if attempts != test.attempts {
+			t.Errorf("status %d: expected %d attempts, got %d", test.status, test.attempts, attempts)
+		}
+	}
+}
+
+type callback struct {
+	sync.Mutex
+	success []interface{}
+	failure []interface{}
+	errs    []error
+}
+
+func (c *callback) Success(msg interface{}) {
+	c.Lock()
+	defer c.Unlock()
+	c.success = append(c.success, msg)
+}
+
+func (c *callback) Failure(msg interface{}, err error) {
+	c.Lock()
+	defer c.Unlock()
+	c.failure = append(c.failure, msg)
+	c.errs = append(c.errs, err)
+}
+
+type panicCallback struct{}
+
+func (panicCallback) Success(msg interface{})            { panic("success") }
+func (panicCallback) Failure(msg interface{}, err error) { panic("failure") }
+
+func TestOnPanic(t *testing.T) {
+	body, server := mockServer()
+	defer server.Close()
+
+	var mtx sync.Mutex
+	var recovered []interface{}
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Callback = panicCallback{}
+	client.OnPanic = func(r interface{}) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		recovered = append(recovered, r)
+	}
+	defer client.Close()
+
+	for i := 0; i < 2; i++ {
+		client.Track(&Track{Event: "Download", UserId: "123456"})
+		client.Flush()
+		if b := <-body; !bytes.Contains(b, []byte("Download")) {
+			t.Errorf("expected the message to be delivered, got %s", b)
+		}
+	}
+
+	mtx.Lock()
+	if len(recovered) != 2 || recovered[0] != "success" {
+		t.Errorf("expected the panics to be recovered, got %v", recovered)
+	}
+	recovered = nil
+	mtx.Unlock()
+
+	var attempts int32
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer flaky.Close()
+
+	cb := new(callback)
+	hooked := New("h97jamjwbh")
+	hooked.Endpoint = flaky.URL
+	hooked.Callback = cb
+	hooked.OnPanic = client.OnPanic
+	hooked.RetryAfter = func(int) time.Duration { return time.Millisecond }
+	hooked.ShouldRetry = func(*http.Response, error) bool { panic("should retry") }
+	hooked.WriteKeyFunc = func() string { panic("write key") }
+	hooked.TraceBatch = func(ctx context.Context, n, size int) (context.Context, func(int, error)) { panic("trace batch") }
+	hooked.Track(&Track{Event: "Download", UserId: "123456"})
+	hooked.Close()
+
+	if len(cb.success) != 1 || atomic.LoadInt32(&attempts) != 2 {
+		t.Errorf("expected the message to be retried by default and delivered, got %d attempts", attempts)
+	}
+	mtx.Lock()
+	defer mtx.Unlock()
+	for _, r := range []interface{}{"should retry", "write key", "trace batch"} {
+		found := false
+		for _, got := range recovered {
+			found = found || got == r
+		}
+		if !found {
+			t.Errorf("expected the %q panic to be recovered, got %v", r, recovered)
+		}
+	}
+}
+
+func TestErrorTypes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	cb := &callback{}
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.MaxRetries = 1
+	client.RetryAfter = func(int) time.Duration { return time.Millisecond }
+	client.Callback = cb
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+	client.Close()
+
+	var exhausted *RetryExhaustedError
+	var apiErr *APIError
+	if len(cb.errs) != 1 || !errors.As(cb.errs[0], &exhausted) || exhausted.Attempts != 2 {
+		t.Fatalf("expected a RetryExhaustedError, got %v", cb.errs)
+	}
+	if !errors.As(cb.errs[0], &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected the APIError of the last attempt, got %v", exhausted.Err)
+	}
+
+	cb = &callback{}
+	client = New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Client.Transport = roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		return nil, errTest
+	})
+	client.Callback = cb
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+	client.Close()
+
+	var sendErr *SendError
+	if len(cb.errs) != 1 || !errors.As(cb.errs[0], &sendErr) || !errors.Is(cb.errs[0], errTest) {
+		t.Errorf("expected a SendError, got %v", cb.errs)
+	}
+
+	var validationErr *ValidationError
+	if err := Validate(&Track{Event: "Download"}); !errors.As(err, &validationErr) {
+		t.Errorf("expected a ValidationError, got %v", err)
+	}
+
+	large := &Track{Event: "Download", UserId: "123456", Properties: Properties{"blob": strings.Repeat("x", maxBatchBytes)}}
+	if err := Validate(large); !errors.As(err, &validationErr) {
+		t.Errorf("expected a ValidationError for a msg over the batch limit, got %v", err)
+	}
+}
+
+func TestPrepareErrorTypes(t *testing.T) {
+	client := pausedClient(10)
+	client.StrictValidation = true
+	client.MaxBatchBytes = 200
+	client.Middlewares = []Middleware{func(msg interface{}) (interface{}, error) {
+		if _, ok := msg.(*Alias); ok {
+			return nil, errTest
+		}
+		return msg, nil
+	}}
+	defer client.Close()
+
+	var validationErr *ValidationError
+	if err := client.Enqueue(struct{}{}); !errors.As(err, &validationErr) {
+		t.Errorf("expected a ValidationError for an unsupported message, got %v", err)
+	}
+	if err := client.Alias(&Alias{PreviousId: "anon", UserId: "123456"}); !errors.As(err, &validationErr) || !errors.Is(err, errTest) {
+		t.Errorf("expected a ValidationError wrapping the middleware error, got %v", err)
+	}
+	large := &Track{Event: "Download", UserId: "123456", Properties: Properties{"blob": strings.Repeat("x", 200)}}
+	if err := client.Track(large); !errors.As(err, &validationErr) {
+		t.Errorf("expected a ValidationError for a msg over MaxBatchBytes, got %v", err)
+	}
+	client.Resume()
+}
+
+var errTest = errors.New("test error")
+
+func TestIdentityHasher(t *testing.T) {
+	client := pausedClient(10)
+	client.IdentityHasher = func(id string) string { return "hashed-" + id }
+
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+	client.Alias(&Alias{PreviousId: "anon", UserId: "123456"})
+	if err := client.Track(&Track{Event: "Download"}); err != errMissingIdentity {
+		t.Errorf("expected the ids to be validated first, got %v", err)
+	}
+
+	msgs := queued(client)
+	track := msgs[0].(*Track)
+	if track.UserId != "hashed-123456" || track.AnonymousId != "" {
+		t.Errorf("expected the user id to be hashed, got %q and %q", track.UserId, track.AnonymousId)
+	}
+	alias := msgs[1].(*Alias)
+	if alias.UserId != "hashed-123456" || alias.PreviousId != "hashed-anon" {
+		t.Errorf("expected the alias ids to be hashed, got %q and %q", alias.UserId, alias.PreviousId)
+	}
+}
+
+func TestReservedContext(t *testing.T) {
+	tests := []struct {
+		context map[string]interface{}
+		field   string
+	}{
+		{map[string]interface{}{"traits": map[string]interface{}{"name": "Jane"}, "ip": "8.8.8.8", "active": true}, ""},
+		{map[string]interface{}{"custom": "anything", "app": nil}, ""},
+		{map[string]interface{}{"traits": "Jane"}, "context.traits"},
+		{map[string]interface{}{"ip": 42}, "context.ip"},
+		{map[string]interface{}{"active": "yes", "device": []string{"ios"}}, "context.active"},
+	}
+
+	for _, test := range tests {
+		err := checkContext(&Track{Context: test.context})
+		if test.field == "" {
+			if err != nil {
+				t.Errorf("expected %v to be valid, got %v", test.context, err)
+			}
+			continue
+		}
+		if e, ok := err.(*FieldError); !ok || e.Field != test.field {
+			t.Errorf("expected a FieldError for %s, got %v", test.field, err)
+		}
+	}
+
+	var logs bytes.Buffer
+	client := pausedClient(10)
+	client.Logger = log.New(&logs, "", 0)
+	track := &Track{Event: "Download", UserId: "123456", Context: map[string]interface{}{"traits": "Jane"}}
+	if err := client.Track(track); err != nil {
+		t.Errorf("expected the message to be kept, got %v", err)
+	}
+	if !strings.Contains(logs.String(), "context.traits") {
+		t.Errorf("expected a warning, got %q", logs.String())
+	}
+
+	client.StrictValidation = true
+	if err := client.Track(track); err == nil {
+		t.Error("expected the message to be rejected with StrictValidation")
+	}
+}
+
+func TestMaxConcurrentRetries(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Size = 1
+	client.MaxConcurrentRetries = 2
+	client.RetryAfter = func(int) time.Duration { return time.Hour }
+	client.ShutdownTimeout = 100 * time.Millisecond
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 50; i++ {
+		client.Track(&Track{Event: "Download", UserId: "123456"})
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for client.Stats().MessagesDropped < 48 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if stats := client.Stats(); stats.MessagesDropped != 48 || stats.MessagesInFlight != 2 {
+		t.Errorf("expected all but 2 batches to be given up on, got %+v", stats)
+	}
+	if n := runtime.NumGoroutine(); n > before+20 {
+		t.Errorf("expected the goroutines to stay bounded, got %d from %d", n, before)
+	}
+	client.Close()
+}
+
+func TestValidateReservedEvents(t *testing.T) {
+	tests := []struct {
+		track *Track
+		field string
+	}{
+		{&Track{Event: "Order Completed", Properties: NewProperties().SetRevenue(19.98).Set("order_id", "50314b8e")}, ""},
+		{&Track{Event: "Custom Event", Properties: Properties{"revenue": "19.98"}}, ""},
+		{&Track{Event: "Order Completed", Properties: Properties{"revenue": "19.98"}}, "properties.revenue"},
+		{&Track{Event: "Product Viewed", Properties: Properties{"price": 9.99, "quantity": "2"}}, "properties.quantity"},
+	}
+
+	for _, test := range tests {
+		err := checkEvent(test.track)
+		if test.field == "" {
+			if err != nil {
+				t.Errorf("expected %s to be valid, got %v", test.track.Event, err)
+			}
+			continue
+		}
+		if e, ok := err.(*FieldError); !ok || e.Field != test.field {
+			t.Errorf("expected a FieldError for %s, got %v", test.field, err)
+		}
+	}
+
+	client := pausedClient(10)
+	client.ValidateReservedEvents = true
+	client.StrictValidation = true
+	if err := client.Track(&Track{Event: "Order Completed", UserId: "123456", Properties: Properties{"total": "19.98"}}); err == nil {
+		t.Error("expected the message to be rejected")
+	}
+}
+
+func TestCallbackFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	cb := new(callback)
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Callback = cb
+
+	first := &Track{Event: "First", UserId: "123456"}
+	second := &Track{Event: "Second", UserId: "123456"}
+	client.Track(first)
+	client.Track(second)
+	client.Close()
+
+	if len(cb.success) != 0 {
+		t.Errorf("expected no successes, got %d", len(cb.success))
+	}
+	if len(cb.failure) != 2 || cb.failure[0] != first || cb.failure[1] != second {
+		t.Fatalf("expected a failure for each message in order, got %v", cb.failure)
+	}
+	if err, ok := cb.errs[0].(*APIError); !ok || err.StatusCode != http.StatusBadRequest || err.Retryable {
+		t.Errorf("expected a non-retryable APIError, got %#v", cb.errs[0])
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	cb := new(callback)
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Callback = cb
+	client.ShutdownTimeout = 100 * time.Millisecond
+
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+
+	start := time.Now()
+	if err := client.Close(); err == nil {
+		t.Error("expected Close to report the timeout")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("expected Close to return shortly after the timeout, took %s", d)
+	}
+	if len(cb.failure) != 1 {
+		t.Errorf("expected the pending message to be reported as failed, got %d", len(cb.failure))
+	}
+}
+
+// Return a server failing every request, and a channel receiving a value
+// once it got the first one.
+func failingServer() (chan struct{}, *httptest.Server) {
+	started := make(chan struct{})
+	var once sync.Once
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		once.Do(func() { close(started) })
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	return started, server
+}
+
+func TestShutdownTimeoutDuringFlush(t *testing.T) {
+	started, server := failingServer()
+	defer server.Close()
+
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Interval = time.Hour
+	client.MaxRetries = 3
+	client.RetryAfter = func(int) time.Duration { return time.Second }
+	client.ShutdownTimeout = 200 * time.Millisecond
+
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+	go client.Flush()
+	<-started
+
+	start := time.Now()
+	if err := client.Close(); err == nil {
+		t.Error("expected Close to report the timeout")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("expected Close to return shortly after the timeout, took %s", d)
+	}
+}
+
+func TestShutdownTimeoutWaitingForWorker(t *testing.T) {
+	started, server := failingServer()
+	defer server.Close()
+
+	cb := new(callback)
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Callback = cb
+	client.Size = 1
+	client.WorkerCount = 1
+	client.MaxRetries = 3
+	client.RetryAfter = func(int) time.Duration { return time.Second }
+	client.ShutdownTimeout = 200 * time.Millisecond
+
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+	<-started
+	// the loop waits for the worker to send the second batch.
+	client.Track(&Track{Event: "Upload", UserId: "123456"})
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	if err := client.Close(); err == nil {
+		t.Error("expected Close to report the timeout")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("expected Close to return shortly after the timeout, took %s", d)
+	}
+	if len(cb.failure) != 2 {
+		t.Errorf("expected both messages to be reported as failed, got %d", len(cb.failure))
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+	agents := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agents <- r.Header.Get("User-Agent")
+	}))
+	defer server.Close()
+
+	for _, agent := range []string{"", "billing-service"} {
+		client := New("h97jamjwbh")
+		client.Endpoint = server.URL
+		client.UserAgent = agent
+		client.Track(&Track{Event: "Download", UserId: "123456"})
+		client.Close()
+	}
+
+	if agent := <-agents; agent != "analytics-go (version: "+Version+")" {
+		t.Errorf("unexpected default User-Agent %q", agent)
+	}
+	if agent := <-agents; agent != "billing-service" {
+		t.Errorf("expected the configured User-Agent, got %q", agent)
+	}
+}
+
+func TestConnectionPool(t *testing.T) {
+	client := New("h97jamjwbh")
+	client.MaxIdleConns = 50
+	client.IdleConnTimeout = time.Minute
+
+	transport, ok := client.httpClient().Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("expected an *http.Transport, got %T", client.httpClient().Transport)
+	}
+	if transport.MaxIdleConns != 50 || transport.MaxIdleConnsPerHost != 50 || transport.IdleConnTimeout != time.Minute {
+		t.Errorf("expected the pool settings to be applied, got %d, %d and %s", transport.MaxIdleConns, transport.MaxIdleConnsPerHost, transport.IdleConnTimeout)
+	}
+	if http.DefaultTransport.(*http.Transport).MaxIdleConnsPerHost == 50 {
+		t.Error("expected http.DefaultTransport to be left alone")
+	}
+
+	custom := roundTripperFunc(http.DefaultTransport.RoundTrip)
+	client = New("h97jamjwbh")
+	client.MaxIdleConns = 50
+	client.Client.Transport = custom
+	if _, ok := client.httpClient().Transport.(roundTripperFunc); !ok {
+		t.Error("expected the Transport of Client to be kept")
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	var out bytes.Buffer
+	cb := &callback{}
+	client := New("h97jamjwbh")
+	client.Endpoint = "http://localhost:0"
+	client.DryRun = true
+	client.DryRunOutput = &out
+	client.Callback = cb
+	client.Client.Transport = roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		t.Errorf("expected no request, got %s %s", r.Method, r.URL)
+		return nil, errors.New("unexpected request")
+	})
+
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+	client.Close()
+
+	if !strings.Contains(out.String(), "\n  \"batch\": [") || !strings.Contains(out.String(), `"event": "Download"`) {
+		t.Errorf("expected the batch as indented JSON, got %s", out.String())
+	}
+	if len(cb.success) != 1 {
+		t.Errorf("expected the message to be reported as sent, got %v", cb.success)
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	headers := make(chan http.Header, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+	}))
+	defer server.Close()
+
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Headers = http.Header{
+		"X-Tenant-Token": {"secret"},
+		"Authorization":  {"Bearer nope"},
+		"Content-Type":   {"text/plain"},
+	}
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+	client.Close()
+
+	h := <-headers
+	if v := h.Get("X-Tenant-Token"); v != "secret" {
+		t.Errorf("expected the custom header, got %q", v)
+	}
+	if v := h.Get("Content-Type"); v != "application/json" {
+		t.Errorf("expected Content-Type to be kept, got %q", v)
+	}
+	if user, _, _ := (&http.Request{Header: h}).BasicAuth(); user != "h97jamjwbh" {
+		t.Errorf("expected the write key to be used for Authorization, got %q", user)
+	}
+}
+
+func TestContentType(t *testing.T) {
+	headers := make(chan http.Header, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+	}))
+	defer server.Close()
+
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.ContentType = "application/vnd.company.events+json"
+	client.Gzip = true
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+	client.Close()
+
+	h := <-headers
+	if v := h.Get("Content-Type"); v != "application/vnd.company.events+json" {
+		t.Errorf("expected the custom Content-Type, got %q", v)
+	}
+	if v := h.Get("Content-Encoding"); v != "gzip" {
+		t.Errorf("expected Content-Encoding to be kept, got %q", v)
+	}
+}
+
+func TestRegion(t *testing.T) {
+	client := New("h97jamjwbh")
+	client.Region = RegionEU
+	if endpoint := client.endpoint(&Track{}); endpoint != EndpointEU {
+		t.Errorf("expected the EU endpoint, got %q", endpoint)
+	}
+
+	client.Endpoint = "https://collector.example.com"
+	if endpoint := client.endpoint(&Track{}); endpoint != client.Endpoint {
+		t.Errorf("expected Endpoint to take precedence over Region, got %q", endpoint)
+	}
+}
+
+func TestRequestHooks(t *testing.T) {
+	body, server := mockServer()
+	defer server.Close()
+
+	var requests, responses []string
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.OnRequest = func(req *http.Request) {
+		ioutil.ReadAll(req.Body)
+		requests = append(requests, req.Method+" "+req.URL.Path)
+	}
+	client.OnResponse = func(res *http.Response, err error) {
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		ioutil.ReadAll(res.Body)
+		responses = append(responses, res.Status)
+	}
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+	client.Close()
+
+	if b := <-body; !bytes.Contains(b, []byte("Download")) {
+		t.Errorf("expected the hooks to leave the body alone, got %s", b)
+	}
+	if len(requests) != 1 || requests[0] != "POST /v1/batch" {
+		t.Errorf("unexpected requests %v", requests)
+	}
+	if len(responses) != 1 || responses[0] != "200 OK" {
+		t.Errorf("unexpected responses %v", responses)
+	}
+}
+
+type framedEncoder struct{}
+
+func (framedEncoder) Encode(w io.Writer, batch Batch) (string, error) {
+	fmt.Fprintf(w, "%d\n", len(batch.Messages))
+	if _, err := (JSONEncoder{}).Encode(w, batch); err != nil {
+		return "", err
+	}
+	return "application/x-framed", nil
+}
+
+func TestEncoder(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		requests <- r
+		bodies <- b
+	}))
+	defer server.Close()
+
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Encoder = framedEncoder{}
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+	client.Close()
+
+	if v := (<-requests).Header.Get("Content-Type"); v != "application/x-framed" {
+		t.Errorf("expected the content type of the encoder, got %q", v)
+	}
+	b := <-bodies
+	if !bytes.HasPrefix(b, []byte("1\n{")) || !bytes.Contains(b, []byte(`"event":"Download"`)) {
+		t.Errorf("expected the batch encoded by the encoder, got %s", b)
+	}
+}
+
+func TestBatchPath(t *testing.T) {
+	requests := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r.Method + " " + r.URL.Path
+	}))
+	defer server.Close()
+
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.BatchPath = "/ingest"
+	client.HTTPMethod = "PUT"
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+	client.Close()
+
+	if r := <-requests; r != "PUT /ingest" {
+		t.Errorf("expected the custom method and path, got %s", r)
+	}
+}
+
+func TestEndpoints(t *testing.T) {
+	tracks, trackServer := mockServer()
+	defer trackServer.Close()
+	identifies, identifyServer := mockServer()
+	defer identifyServer.Close()
+
+	client := New("h97jamjwbh")
+	client.Endpoint = trackServer.URL
+	client.Endpoints = map[string]string{"identify": identifyServer.URL}
+
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+	client.Identify(&Identify{UserId: "123456"})
+	client.Close()
+
+	for body, typ := range map[chan []byte]string{tracks: "track", identifies: "identify"} {
+		var v struct {
+			Batch []Message `json:"batch"`
+		}
+		json.Unmarshal(<-body, &v)
+		if len(v.Batch) != 1 || v.Batch[0].Type != typ {
+			t.Errorf("expected a single %s message, got %+v", typ, v.Batch)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, test := range []struct {
+		msg   interface{}
+		valid bool
+	}{
+		{&Track{Event: "Download", UserId: "123456"}, true},
+		{&Track{UserId: "123456"}, false},
+		{&Group{GroupId: "1", AnonymousId: "abc"}, true},
+		{&Group{UserId: "123456"}, false},
+		{&Alias{UserId: "123456"}, false},
+		{"track", false},
+	} {
+		if err := Validate(test.msg); (err == nil) != test.valid {
+			t.Errorf("Validate(%#v) = %v", test.msg, err)
+		}
+	}
+}
+
+func TestSampleRate(t *testing.T) {
+	client := New("h97jamjwbh")
+	client.SampleRate = 0.25
+
+	kept := 0
+	for i := 0; i < 1000; i++ {
+		msg := &Track{Message: Message{Type: "track", MessageId: fmt.Sprint(i)}}
+		if client.sampled(msg) {
+			kept++
+		}
+		if client.sampled(msg) != client.sampled(msg) {
+			t.Fatalf("expected a consistent decision for message %d", i)
+		}
+	}
+	if kept < 200 || kept > 300 {
+		t.Errorf("expected about 250 of 1000 messages to be kept, got %d", kept)
+	}
+
+	for i := 0; i < 100; i++ {
+		msg := &Identify{Message: Message{Type: "identify", MessageId: fmt.Sprint(i)}}
+		if !client.sampled(msg) {
+			t.Fatal("expected identify messages to never be sampled out")
+		}
+	}
+}
+
+func TestMiddlewares(t *testing.T) {
+	client := pausedClient(1)
+	client.Middlewares = []Middleware{
+		func(msg interface{}) (interface{}, error) {
+			if track, ok := msg.(*Track); ok {
+				track.Properties = map[string]interface{}{"deploy": "v42"}
+			}
+			return msg, nil
+		},
+		func(msg interface{}) (interface{}, error) {
+			if _, ok := msg.(*Identify); ok {
+				return nil, fmt.Errorf("identify is not allowed")
+			}
+			return msg, nil
+		},
+	}
+
+	if err := client.Identify(&Identify{UserId: "123456"}); err == nil {
+		t.Error("expected the middleware error to be returned")
+	}
+
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+	if v := queued(client)[0].(*Track).Properties["deploy"]; v != "v42" {
+		t.Errorf("expected the message to be enriched, got %v", v)
+	}
+}
+
+func TestLibraryContext(t *testing.T) {
+	client := pausedClient(2)
+
+	shared := map[string]interface{}{"ip": "127.0.0.1"}
+	client.Track(&Track{Event: "Download", UserId: "123456", Context: shared})
+	client.Alias(&Alias{UserId: "123456", PreviousId: "abc", Context: map[string]interface{}{
+		"library": "custom",
+	}})
+
+	msgs := queued(client)
+	if ctx := msgs[0].(*Track).Context; ctx["library"] == nil || ctx["ip"] != "127.0.0.1" {
+		t.Errorf("expected the library to be added to the context, got %v", ctx)
+	}
+	if _, ok := shared["library"]; ok {
+		t.Error("expected the caller's context to be left untouched")
+	}
+	if lib := msgs[1].(*Alias).Context["library"]; lib != "custom" {
+		t.Errorf("expected the caller's library to be kept, got %v", lib)
+	}
+}
+
+func TestMaxBatchBytes(t *testing.T) {
+	batches := make(chan int, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var v struct {
+			Batch []interface{} `json:"batch"`
+		}
+		json.NewDecoder(r.Body).Decode(&v)
+		batches <- len(v.Batch)
+	}))
+	defer server.Close()
+
+	cb := new(callback)
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Callback = cb
+	client.MaxBatchBytes = 600
+
+	huge := &Track{Event: "Huge", UserId: "123456", Properties: map[string]interface{}{
+		"blob": string(make([]byte, 1000)),
+	}}
+	client.Track(huge)
+	for i := 0; i < 3; i++ {
+		client.Track(&Track{Event: "Download", UserId: "123456"})
+	}
+	client.Close()
+	close(batches)
+
+	n := 0
+	for size := range batches {
+		if size > 0 {
+			n++
+		}
+	}
+	if n < 2 {
+		t.Errorf("expected the messages to be split into several batches, got %d", n)
+	}
+	if len(cb.failure) != 1 || cb.failure[0] != huge {
+		t.Errorf("expected the oversized message to be reported as failed, got %v", cb.failure)
+	}
+}
+
+func TestSplitOversizedBatch(t *testing.T) {
+	batches := make(chan int, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var v struct {
+			Batch []interface{} `json:"batch"`
+		}
+		json.NewDecoder(r.Body).Decode(&v)
+		batches <- len(v.Batch)
+	}))
+	defer server.Close()
+
+	cb := new(callback)
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Callback = cb
+
+	blob := func(n int) map[string]interface{} {
+		return map[string]interface{}{"blob": string(bytes.Repeat([]byte("a"), n))}
+	}
+	client.Track(&Track{Event: "Large", UserId: "123456", Properties: blob(300 * 1024)})
+	client.Track(&Track{Event: "Large", UserId: "123456", Properties: blob(300 * 1024)})
+	var validationErr *ValidationError
+	huge := &Track{Event: "Huge", UserId: "123456", Properties: blob(600 * 1024)}
+	if err := client.Track(huge); !errors.As(err, &validationErr) {
+		t.Errorf("expected the oversized message to be rejected, got %v", err)
+	}
+	client.Close()
+	close(batches)
+
+	n := 0
+	for size := range batches {
+		if size != 1 {
+			t.Errorf("expected batches of a single message, got %d", size)
+		}
+		n++
+	}
+	if n != 2 {
+		t.Errorf("expected 2 uploads, got %d", n)
+	}
+	if len(cb.failure) != 0 {
+		t.Errorf("expected no failures, got %d", len(cb.failure))
+	}
+}
+
+func TestRand(t *testing.T) {
+	ids := func() []string {
+		client := pausedClient(2)
+		client.Rand = rand.New(rand.NewSource(42))
+		client.Track(&Track{Event: "Download", UserId: "123456"})
+		client.Track(&Track{Event: "Download", UserId: "123456"})
+		msgs := queued(client)
+		return []string{msgs[0].(message).id(), msgs[1].(message).id()}
+	}
+
+	first, second := ids(), ids()
+	if first[0] == first[1] {
+		t.Errorf("expected distinct ids, got %v", first)
+	}
+	if first[0] != second[0] || first[1] != second[1] {
+		t.Errorf("expected the same ids from the same seed, got %v and %v", first, second)
+	}
+}
+
+func TestHistorical(t *testing.T) {
+	paths := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.Path
+	}))
+	defer server.Close()
+
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Historical = true
+
+	if err := client.Track(&Track{Event: "Download", UserId: "123456"}); err == nil {
+		t.Error("expected messages without a timestamp to be rejected")
+	}
+
+	client.Track(&Track{Event: "Download", UserId: "123456", Message: Message{
+		Timestamp: "2012-07-10T23:00:00+0000",
+	}})
+	client.Close()
+
+	if path := <-paths; path != "/v1/import" {
+		t.Errorf("expected the import API to be used, got %s", path)
+	}
+}
+
+func TestWriteKeyFunc(t *testing.T) {
+	keys := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, _, _ := r.BasicAuth()
+		keys <- key
+	}))
+	defer server.Close()
+
+	var key atomic.Value
+	key.Store("first")
+
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.WriteKeyFunc = func() string { return key.Load().(string) }
+	defer client.Close()
+
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+	client.Flush()
+	key.Store("second")
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+	client.Flush()
+
+	if first, second := <-keys, <-keys; first != "first" || second != "second" {
+		t.Errorf("expected the rotated key to be used, got %s then %s", first, second)
+	}
+}
+
+func TestNewBackoffPolicy(t *testing.T) {
+	policy := NewBackoffPolicy(100*time.Millisecond, time.Second, 0.5)
+
+	for attempt, max := range []time.Duration{150, 300, 600, 1000} {
+		max *= time.Millisecond
+		for i := 0; i < 100; i++ {
+			if d := policy(attempt); d < max/3 || d > max {
+				t.Fatalf("attempt %d: delay %s out of bounds", attempt, d)
+			}
+		}
+	}
+}
+
+func TestErrClosed(t *testing.T) {
+	client := New("h97jamjwbh")
+	client.Close()
+
+	if err := client.Track(&Track{Event: "Download", UserId: "123456"}); err != ErrClosed {
+		t.Errorf("expected ErrClosed from Track, got %v", err)
+	}
+	if err := client.Flush(); err != ErrClosed {
+		t.Errorf("expected ErrClosed from Flush, got %v", err)
+	}
+	if err := client.Close(); err != ErrClosed {
+		t.Errorf("expected ErrClosed from Close, got %v", err)
+	}
+}
+
+func TestEnqueueWhileClosing(t *testing.T) {
+	body, server := mockServer()
+	defer server.Close()
+	go func() {
+		for range body {
+		}
+	}()
+
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				err := client.Track(&Track{Event: "Download", UserId: "123456"})
+				if err == ErrClosed {
+					return
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	client.Close()
+	wg.Wait()
+}
+
+func TestDedup(t *testing.T) {
+	client := pausedClient(10)
+	client.Dedup = true
+
+	for i := 0; i < 3; i++ {
+		client.Track(&Track{Event: "Download", UserId: "123456", Message: Message{MessageId: "abc"}})
+		client.Track(&Track{Event: "Download", UserId: "123456"})
+	}
+
+	if n := client.Stats().QueueLength; n != 4 {
+		t.Errorf("expected duplicates of the explicit id to be dropped, got %d messages", n)
+	}
+	if n := client.Stats().MessagesDropped; n != 2 {
+		t.Errorf("expected the duplicates to be counted as dropped, got %d", n)
+	}
+}
+
+func TestPropertiesAndTraits(t *testing.T) {
+	track := &Track{
+		Event:      "Order Completed",
+		UserId:     "123456",
+		Properties: NewProperties().Set("orderId", "50314b8e").SetRevenue(19.98).SetCurrency("USD"),
+	}
+	if track.Properties["revenue"] != 19.98 || track.Properties["orderId"] != "50314b8e" {
+		t.Errorf("unexpected properties %v", track.Properties)
+	}
+
+	identify := &Identify{
+		UserId: "123456",
+		Traits: NewTraits().SetEmail("jane@example.com").SetName("Jane").SetCreatedAt(mockTime()),
+	}
+	if identify.Traits["createdAt"] != "2009-11-10T23:00:00+0000" || identify.Traits["email"] != "jane@example.com" {
+		t.Errorf("unexpected traits %v", identify.Traits)
+	}
+}
+
+func TestMaxTimestampSkew(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	client := New("h97jamjwbh")
+	client.now = mockTime
+	client.Sync = true
+	client.Endpoint = server.URL
+	client.MaxTimestampSkew = time.Hour
+
+	err := client.Track(&Track{Event: "Download", UserId: "123456", Message: Message{
+		Timestamp: "2009-11-11T03:00:00+0000",
+	}})
+	if e, ok := err.(*FieldError); !ok || e.Field != "timestamp" {
+		t.Errorf("expected a timestamp FieldError, got %v", err)
+	}
+
+	err = client.Track(&Track{Event: "Download", UserId: "123456", Message: Message{
+		Timestamp: "2009-11-10T23:30:00Z",
+	}})
+	if err != nil {
+		t.Errorf("expected a timestamp within the tolerance to be accepted, got %v", err)
+	}
+}
+
+func TestTraceBatch(t *testing.T) {
+	body, server := mockServer()
+	defer server.Close()
+
+	type key struct{}
+	var n, size, retries int
+	var err error
+	var traced interface{}
+
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Sync = true
+	client.HTTPClient = &http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			traced = r.Context().Value(key{})
+			return http.DefaultTransport.RoundTrip(r)
+		}),
+	}
+	client.TraceBatch = func(ctx context.Context, msgs, bytes int) (context.Context, func(int, error)) {
+		n, size = msgs, bytes
+		return context.WithValue(ctx, key{}, "span"), func(r int, e error) {
+			retries, err = r, e
+		}
+	}
+
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+	<-body
+
+	if n != 1 || size == 0 {
+		t.Errorf("expected a traced batch of 1 message, got %d messages and %d bytes", n, size)
+	}
+	if retries != 0 || err != nil {
+		t.Errorf("expected the batch to be sent without retries, got %d and %v", retries, err)
+	}
+	if traced != "span" {
+		t.Error("expected the traced context to be used for the request")
+	}
+}
+
+func TestEnqueueBatch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Interval = time.Hour
+	defer client.Close()
+
+	err := client.EnqueueBatch(
+		&Track{Event: "Checkout Started", UserId: "123456"},
+		&Track{Event: "Order Completed"},
+	)
+	if err == nil {
+		t.Error("expected the invalid message to be rejected")
+	}
+	if n := client.Stats().MessagesEnqueued; n != 0 {
+		t.Errorf("expected no message to be queued, got %d", n)
+	}
+
+	err = client.EnqueueBatch(
+		&Track{Event: "Checkout Started", UserId: "123456"},
+		&Track{Event: "Order Completed", UserId: "123456"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := client.Stats().MessagesEnqueued; n != 2 {
+		t.Errorf("expected 2 queued messages, got %d", n)
+	}
+}
+
+func TestMsgpack(t *testing.T) {
+	b, err := appendMsgpack(nil, map[string]interface{}{
+		"b": []interface{}{true, nil, "x"},
+		"a": json.Number("1"),
+		"c": json.Number("-200"),
+		"d": json.Number("1.5"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{
+		0x84,
+		0xa1, 'a', 0x01,
+		0xa1, 'b', 0x93, 0xc3, 0xc0, 0xa1, 'x',
+		0xa1, 'c', 0xd1, 0xff, 0x38,
+		0xa1, 'd', 0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0,
+	}
+	if !bytes.Equal(b, expected) {
+		t.Errorf("expected % x, got % x", expected, b)
+	}
+
+	types := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		types <- r.Header.Get("Content-Type")
+	}))
+	defer server.Close()
+
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Sync = true
+	client.Encoding = EncodingMsgpack
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+
+	if typ := <-types; typ != "application/msgpack" {
+		t.Errorf("expected a msgpack content type, got %s", typ)
+	}
+}
+
+func TestGenerateMessageID(t *testing.T) {
+	body, server := mockServer()
+	defer server.Close()
+
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Sync = true
+	client.GenerateMessageID = false
+
+	if err := client.Track(&Track{Event: "Download", UserId: "123456"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var batch struct {
+		Batch []map[string]interface{} `json:"batch"`
+	}
+	if err := json.Unmarshal(<-body, &batch); err != nil {
+		t.Fatal(err)
+	}
+	if id, ok := batch.Batch[0]["messageId"]; ok {
+		t.Errorf("expected the messageId to be omitted, got %v", id)
+	}
+}
+
+func TestAutoAnonymousId(t *testing.T) {
+	client := New("h97jamjwbh")
+	client.AutoAnonymousId = true
+
+	first, second := &Track{Event: "Download"}, &Page{Name: "Home"}
+	identified := &Track{Event: "Download", UserId: "123456"}
+	client.setAnonymousId(first)
+	client.setAnonymousId(second)
+	client.setAnonymousId(identified)
+
+	if first.AnonymousId == "" || second.AnonymousId == "" || first.AnonymousId == second.AnonymousId {
+		t.Errorf("expected distinct generated anonymous ids, got %q and %q", first.AnonymousId, second.AnonymousId)
+	}
+	if identified.AnonymousId != "" {
+		t.Errorf("expected identified messages to be left alone, got %q", identified.AnonymousId)
+	}
+
+	client.StickyAnonymousId = true
+	first, second = &Track{Event: "Download"}, &Page{Name: "Home"}
+	client.setAnonymousId(first)
+	client.setAnonymousId(second)
+
+	if first.AnonymousId == "" || first.AnonymousId != second.AnonymousId {
+		t.Errorf("expected the same sticky anonymous id, got %q and %q", first.AnonymousId, second.AnonymousId)
+	}
+
+	if _, err := client.prepare(&Track{Event: "Download"}); err != nil {
+		t.Errorf("expected the message to pass validation, got %v", err)
+	}
+}
+
+func TestCloseWithStats(t *testing.T) {
+	failing := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Interval = time.Hour
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+
+	stats, err := client.CloseWithStats()
+	if err != nil || stats != (ShutdownStats{Flushed: 2}) {
+		t.Errorf("expected 2 flushed messages, got %+v and %v", stats, err)
+	}
+	if _, err := client.CloseWithStats(); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+
+	failing = true
+	client = New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Interval = time.Hour
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+
+	if stats, _ := client.CloseWithStats(); stats != (ShutdownStats{Dropped: 1}) {
+		t.Errorf("expected 1 dropped message, got %+v", stats)
+	}
+}
+
+func TestMaxRequestsPerSecond(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Sync = true
+	client.MaxRequestsPerSecond = 20
+
+	start := time.Now()
+	for i := 0; i < 25; i++ {
+		client.Track(&Track{Event: "Download", UserId: "123456"})
+	}
+
+	// The first 20 requests are let through right away, the next 5 at 20
+	// per second.
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("expected the requests to be throttled, took %s", elapsed)
+	}
+}
+
+func TestLimiterCancel(t *testing.T) {
+	var l limiter
+	for i := 0; i < 10; i++ {
+		l.wait(context.Background(), 10)
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < 5; i++ {
+		if err := l.wait(cancelled, 10); err != context.Canceled {
+			t.Fatalf("expected the wait to be cancelled, got %v", err)
+		}
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	start := time.Now()
+	l.wait(context.Background(), 10)
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("expected the tokens of cancelled waits to be given back, waited %s", elapsed)
+	}
+}
+
+func TestRetryAfterHeader(t *testing.T) {
+	client := New("h97jamjwbh")
+	client.now = mockTime
+
+	for header, expected := range map[string]time.Duration{
+		"":                              0,
+		"120":                           2 * time.Minute,
+		"-1":                            0,
+		"Tue, 10 Nov 2009 23:00:30 GMT": 30 * time.Second,
+		"Tue, 10 Nov 2009 22:00:00 GMT": 0,
+		"soon":                          0,
+	} {
+		if d := client.parseRetryAfter(header); d != expected {
+			t.Errorf("expected %q to be parsed as %s, got %s", header, expected, d)
+		}
+	}
+
+	var attempts []time.Time
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts = append(attempts, time.Now())
+		if len(attempts) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer server.Close()
+
+	client = New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Sync = true
+	client.RetryAfter = func(int) time.Duration { return 0 }
+
+	if err := client.Track(&Track{Event: "Download", UserId: "123456"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(attempts) != 2 || attempts[1].Sub(attempts[0]) < time.Second {
+		t.Errorf("expected the retry to wait for the Retry-After delay, got %v", attempts)
+	}
+}
+
+// In-memory store, without the taken bookkeeping.
+type memStore struct {
+	sync.Mutex
+	seq   int
+	msgs  map[string][]byte
+	order []string
+}
+
+func (s *memStore) Put(msg []byte) (string, error) {
+	s.Lock()
+	defer s.Unlock()
+	s.seq++
+	id := strconv.Itoa(s.seq)
+	s.msgs[id] = msg
+	return id, nil
+}
+
+func (s *memStore) Get(n int) ([]StoredMessage, error) {
+	s.Lock()
+	defer s.Unlock()
+	var msgs []StoredMessage
+	for len(s.order) > 0 && len(msgs) < n {
+		id := s.order[0]
+		s.order = s.order[1:]
+		msgs = append(msgs, StoredMessage{Id: id, Data: s.msgs[id]})
+	}
+	return msgs, nil
+}
+
+func (s *memStore) Ack(ids ...string) error {
+	s.Lock()
+	defer s.Unlock()
+	for _, id := range ids {
+		delete(s.msgs, id)
+	}
+	return nil
+}
+
+func (s *memStore) Nack(ids ...string) error {
+	return nil
+}
+
+func TestStore(t *testing.T) {
+	batches := make(chan []byte, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		batches <- b
+	}))
+	defer server.Close()
+
+	store := &memStore{
+		msgs:  map[string][]byte{"left": []byte(`{"type":"track","event":"Left Over","userId":"123456"}`)},
+		order: []string{"left"},
+	}
+
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Interval = time.Hour
+	client.Store = store
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+
+	if len(store.msgs) != 2 {
+		t.Errorf("expected the queued message to be stored, got %v", store.msgs)
+	}
+	client.Close()
+	close(batches)
+
+	var events []string
+	for b := range batches {
+		var batch struct {
+			Batch []struct {
+				Event string `json:"event"`
+			} `json:"batch"`
+		}
+		json.Unmarshal(b, &batch)
+		for _, msg := range batch.Batch {
+			events = append(events, msg.Event)
+		}
+	}
+	sort.Strings(events)
+	if !reflect.DeepEqual(events, []string{"Download", "Left Over"}) {
+		t.Errorf("expected the queued and left over messages to be sent, got %v", events)
+	}
+	if len(store.msgs) != 0 {
+		t.Errorf("expected the sent messages to be acked, got %v", store.msgs)
+	}
+}
+
+func TestStoreStart(t *testing.T) {
+	paths := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		paths <- r.URL.Path
+	}))
+	defer server.Close()
+
+	store := &memStore{
+		msgs: map[string][]byte{
+			"track":    []byte(`{"type":"track","event":"Left Over","userId":"123456"}`),
+			"identify": []byte(`{"type":"identify","userId":"123456"}`),
+		},
+		order: []string{"track", "identify"},
+	}
+
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Endpoints = map[string]string{"identify": server.URL + "/identify"}
+	client.Interval = time.Hour
+	client.Store = store
+	defer client.Close()
+
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for i := 0; i < 2; i++ {
+		select {
+		case path := <-paths:
+			got = append(got, path)
+		case <-time.After(time.Second):
+			t.Fatal("expected the stored messages to be replayed once started")
+		}
+	}
+	sort.Strings(got)
+	if want := []string{"/identify/v1/batch", "/v1/batch"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the stored messages to be sent to the endpoint of their type, got %v", got)
+	}
+}
+
+func TestStoreFailure(t *testing.T) {
+	_, server := failingServer()
+	defer server.Close()
+
+	store := &memStore{msgs: map[string][]byte{}}
+	callback := new(callback)
+
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Interval = time.Hour
+	client.MaxRetries = 1
+	client.RetryAfter = func(int) time.Duration { return time.Millisecond }
+	client.Store = store
+	client.Callback = callback
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+	client.Close()
+
+	if len(callback.failure) != 1 {
+		t.Errorf("expected the message to be reported as failed, got %v", callback.failure)
+	}
+	if len(store.msgs) != 0 {
+		t.Errorf("expected the failed message to be acked rather than replayed, got %v", store.msgs)
+	}
+}
+
+func TestFlushTimeout(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			time.Sleep(200 * time.Millisecond)
+		}
+	}))
+	defer server.Close()
+
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Sync = true
+	client.FlushTimeout = 50 * time.Millisecond
+	client.RetryAfter = func(int) time.Duration { return 0 }
+
+	if err := client.Track(&Track{Event: "Download", UserId: "123456"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&attempts); n != 2 {
+		t.Errorf("expected the timed out request to be retried, got %d attempts", n)
+	}
+}
+
+func TestScreen(t *testing.T) {
+	err := Validate(&Screen{UserId: "123456"})
+	if e, ok := err.(*FieldError); !ok || e.Field != "name" {
+		t.Errorf("expected a name FieldError, got %v", err)
+	}
+
+	err = Validate(&Screen{Name: "Home"})
+	if e, ok := err.(*FieldError); !ok || e.Field != "userId" {
+		t.Errorf("expected a userId FieldError, got %v", err)
+	}
+
+	screen := &Screen{Name: "Home", AnonymousId: "a1b2c3"}
+	if err := Validate(screen); err != nil || screen.Type != "screen" {
+		t.Errorf("expected a valid screen, got %v and type %q", err, screen.Type)
+	}
+}
+
+func TestDefaultIntegrations(t *testing.T) {
+	defaults := map[string]interface{}{"All": false, "Salesforce": true}
+	client := New("h97jamjwbh")
+	client.DefaultIntegrations = defaults
+
+	overrides := map[string]interface{}{"Salesforce": false, "Mixpanel": true}
+	track := &Track{Event: "Download", UserId: "123456", Integrations: overrides}
+	alias := &Alias{PreviousId: "a1b2c3", UserId: "123456"}
+	setIntegrations(track, client.DefaultIntegrations)
+	setIntegrations(alias, client.DefaultIntegrations)
+
+	expected := map[string]interface{}{"All": false, "Salesforce": false, "Mixpanel": true}
+	if !reflect.DeepEqual(track.Integrations, expected) {
+		t.Errorf("expected %v, got %v", expected, track.Integrations)
+	}
+	if !reflect.DeepEqual(alias.Integrations, defaults) {
+		t.Errorf("expected %v, got %v", defaults, alias.Integrations)
+	}
+	if len(overrides) != 2 || len(defaults) != 2 {
+		t.Error("expected the maps of the caller to be left alone")
+	}
+}
+
+type dropCallback struct {
+	callback
+	drops []DropReason
+}
+
+func (c *dropCallback) Drop(msg interface{}, reason DropReason) {
+	c.Lock()
+	defer c.Unlock()
+	c.drops = append(c.drops, reason)
+}
+
+func TestDropCallback(t *testing.T) {
+	cb := new(dropCallback)
+	client := pausedClient(1)
+	client.Callback = cb
+	client.OverflowPolicy = DropNewest
+
+	client.Track(&Track{Event: "Download"})
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+	client.SampleRate = 0.000000001
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+
+	expected := []DropReason{DropInvalid, DropQueueFull, DropSampled}
+	if !reflect.DeepEqual(cb.drops, expected) {
+		t.Errorf("expected drops %v, got %v", expected, cb.drops)
+	}
+	if len(cb.failure) != 0 {
+		t.Errorf("expected no failure, got %v", cb.failure)
+	}
+}
+
+func TestDropDuplicate(t *testing.T) {
+	cb := new(dropCallback)
+	client := pausedClient(10)
+	client.Callback = cb
+	client.Dedup = true
+	defer client.Close()
+
+	for i := 0; i < 2; i++ {
+		client.Track(&Track{Event: "Download", UserId: "123456", Message: Message{MessageId: "abc"}})
+	}
+
+	if expected := []DropReason{DropDuplicate}; !reflect.DeepEqual(cb.drops, expected) {
+		t.Errorf("expected drops %v, got %v", expected, cb.drops)
+	}
+	client.Resume()
+}
+
+func TestWorkerCount(t *testing.T) {
+	var concurrent, max int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&concurrent, 1)
+		defer atomic.AddInt32(&concurrent, -1)
+		for {
+			m := atomic.LoadInt32(&max)
+			if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	for _, workers := range []int32{1, 3} {
+		atomic.StoreInt32(&max, 0)
+		client := New("h97jamjwbh")
+		client.Endpoint = server.URL
+		client.Size = 1
+		client.WorkerCount = int(workers)
+		for i := 0; i < 10; i++ {
+			client.Track(&Track{Event: "Download", UserId: "123456"})
+		}
+		client.Close()
+
+		if m := atomic.LoadInt32(&max); m > workers {
+			t.Errorf("expected at most %d concurrent uploads, got %d", workers, m)
+		}
+	}
+}
+
+func TestHomogeneousBatches(t *testing.T) {
+	batches := make(chan []byte, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		batches <- b
+	}))
+	defer server.Close()
+
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Interval = time.Hour
+	client.HomogeneousBatches = true
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+	client.Identify(&Identify{UserId: "123456"})
+	client.Track(&Track{Event: "Upload", UserId: "123456"})
+	client.Close()
+	close(batches)
+
+	var types []string
+	for b := range batches {
+		var batch struct {
+			Batch []struct {
+				Type string `json:"type"`
+			} `json:"batch"`
+		}
+		json.Unmarshal(b, &batch)
+		var typ []string
+		for _, msg := range batch.Batch {
+			typ = append(typ, msg.Type)
+		}
+		types = append(types, strings.Join(typ, ","))
+	}
+	sort.Strings(types)
+	if !reflect.DeepEqual(types, []string{"identify", "track,track"}) {
+		t.Errorf("expected a batch per type, got %v", types)
+	}
+}
+
+func TestFieldMapping(t *testing.T) {
+	body, server := mockServer()
+	defer server.Close()
+
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Sync = true
+	client.now = mockTime
+	client.FieldMapping = map[string]string{"type": "event_type", "timestamp": "ts"}
+	client.Track(&Track{Event: "Download", UserId: "123456", Properties: map[string]interface{}{"type": "pdf"}})
+
+	var batch struct {
+		Batch []map[string]interface{} `json:"batch"`
+	}
+	if err := json.Unmarshal(<-body, &batch); err != nil {
+		t.Fatal(err)
+	}
+	msg := batch.Batch[0]
+	if msg["event_type"] != "track" || msg["ts"] != "2009-11-10T23:00:00+0000" {
+		t.Errorf("expected the fields to be renamed, got %v", msg)
+	}
+	if _, ok := msg["type"]; ok {
+		t.Errorf("expected the original field to be gone, got %v", msg)
+	}
+	if properties := msg["properties"].(map[string]interface{}); properties["type"] != "pdf" {
+		t.Errorf("expected the properties to be left alone, got %v", properties)
+	}
+}
+
+func TestPause(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+	}))
+	defer server.Close()
+
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Interval = 10 * time.Millisecond
+	client.Size = 1
+	client.Pause()
+
+	for i := 0; i < 3; i++ {
+		client.Track(&Track{Event: "Download", UserId: "123456"})
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Errorf("expected no request while paused, got %d", n)
+	}
+	if n := client.Stats().QueueLength; n != 3 {
+		t.Errorf("expected the messages to stay queued, got %d", n)
+	}
+
+	client.Resume()
+	client.Flush()
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Errorf("expected 3 requests once resumed, got %d", n)
+	}
+
+	client.Pause()
+	client.Close()
+}
+
+type batchCallback struct {
+	callback
+	counts []int
+	bytes  []int
+}
+
+func (c *batchCallback) BatchSuccess(count int, bytes int, duration time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.counts = append(c.counts, count)
+	c.bytes = append(c.bytes, bytes)
+}
+
+func TestBatchCallback(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	cb := new(batchCallback)
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Interval = time.Hour
+	client.Callback = cb
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+	client.Track(&Track{Event: "Upload", UserId: "123456"})
+	client.Close()
+
+	if !reflect.DeepEqual(cb.counts, []int{2}) || cb.bytes[0] == 0 {
+		t.Errorf("expected a batch of 2 messages, got %v and %v bytes", cb.counts, cb.bytes)
+	}
+	if len(cb.success) != 2 {
+		t.Errorf("expected the messages to be reported as well, got %v", cb.success)
+	}
+}
+
+type retryCallback struct {
+	callback
+	retries  []int
+	attempts []int
+}
+
+func (c *retryCallback) Retry(attempt int, err error) {
+	c.Lock()
+	defer c.Unlock()
+	c.retries = append(c.retries, attempt)
+}
+
+func (c *retryCallback) SuccessAfter(attempts int) {
+	c.Lock()
+	defer c.Unlock()
+	c.attempts = append(c.attempts, attempts)
+}
+
+func TestRetryCallback(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	cb := new(retryCallback)
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Interval = time.Hour
+	client.RetryAfter = func(int) time.Duration { return time.Millisecond }
+	client.Callback = cb
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+	client.Close()
+
+	if !reflect.DeepEqual(cb.retries, []int{1}) {
+		t.Errorf("expected a single retry, got %v", cb.retries)
+	}
+	if !reflect.DeepEqual(cb.attempts, []int{2}) {
+		t.Errorf("expected a success after 2 attempts, got %v", cb.attempts)
+	}
+	if len(cb.success) != 1 {
+		t.Errorf("expected the message to be reported as well, got %v", cb.success)
+	}
+}
+
+func TestStrictValidation(t *testing.T) {
+	client := New("h97jamjwbh")
+	client.StrictValidation = true
+	client.MaxBatchBytes = 200
+
+	if err := client.Track(&Track{Event: "Download"}); err == nil {
+		t.Error("expected the message without identity to be rejected")
+	} else if e, ok := err.(*FieldError); !ok || e.Field != "userId" {
+		t.Errorf("expected a userId FieldError, got %v", err)
+	}
+
+	err := client.Track(&Track{Event: "Download", UserId: "123456", Message: Message{Timestamp: "yesterday"}})
+	if e, ok := err.(*FieldError); !ok || e.Field != "timestamp" {
+		t.Errorf("expected a timestamp FieldError, got %v", err)
+	}
+
+	err = client.Track(&Track{Event: "Download", UserId: "123456", Properties: map[string]interface{}{
+		"description": strings.Repeat("x", 200),
+	}})
+	if err == nil {
+		t.Error("expected the oversized message to be rejected")
+	}
+	if n := client.Stats().MessagesEnqueued; n != 0 {
+		t.Errorf("expected nothing to be queued, got %d", n)
+	}
+}
+
+func TestVerboseResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid batch"}` + strings.Repeat(" ", 2000)))
+	}))
+	defer server.Close()
+
+	var logs bytes.Buffer
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Sync = true
+	client.Verbose = true
+	client.Logger = log.New(&logs, "", 0)
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+
+	if !strings.Contains(logs.String(), `response 400 Bad Request – {"error":"invalid batch"}`) {
+		t.Errorf("expected the response to be logged, got %s", logs.String())
+	}
+	if strings.Contains(logs.String(), strings.Repeat(" ", 1500)) {
+		t.Error("expected the response body to be truncated")
+	}
+	if strings.Contains(logs.String(), "h97jamjwbh") {
+		t.Error("expected the write key not to be logged")
+	}
+}
+
+func TestSendBatch(t *testing.T) {
+	body, server := mockServer()
+	defer server.Close()
+
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.now = mockTime
+
+	err := client.SendBatch(&Batch{
+		Messages: []interface{}{&Track{Event: "Download", UserId: "123456"}, &Track{Event: "Upload"}},
+	})
+	if err == nil {
+		t.Error("expected the batch with an invalid message to be rejected")
+	}
+
+	sentAt := "2009-11-10T22:59:00+0000"
+	err = client.SendBatch(&Batch{
+		Context: map[string]interface{}{"ip": "127.0.0.1"},
+		Messages: []interface{}{&Track{Event: "Download", UserId: "123456", Message: Message{
+			Timestamp: "2009-11-10T22:58:00+0000",
+			SentAt:    sentAt,
+		}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var batch struct {
+		Context map[string]interface{}   `json:"context"`
+		SentAt  string                   `json:"sentAt"`
+		Batch   []map[string]interface{} `json:"batch"`
+	}
+	if err := json.Unmarshal(<-body, &batch); err != nil {
+		t.Fatal(err)
+	}
+	if batch.SentAt != "2009-11-10T23:00:00+0000" || batch.Context["ip"] != "127.0.0.1" {
+		t.Errorf("unexpected batch fields %+v", batch)
+	}
+	if msg := batch.Batch[0]; msg["timestamp"] != "2009-11-10T22:58:00+0000" || msg["sentAt"] != sentAt {
+		t.Errorf("expected the message timestamps to be left alone, got %v", msg)
+	}
+}
+
+func TestRedactKeys(t *testing.T) {
+	client := New("h97jamjwbh")
+	client.RedactKeys = []string{"ssn", "DOB"}
+
+	traits := map[string]interface{}{
+		"name": "Jane",
+		"SSN":  "078-05-1120",
+		"family": []interface{}{
+			map[string]interface{}{"name": "John", "dob": "1970-01-01"},
+		},
+	}
+	identify := &Identify{UserId: "123456", Traits: traits, Context: map[string]interface{}{
+		"traits": map[string]interface{}{"ssn": "078-05-1120"},
+	}}
+	if _, err := client.prepare(identify); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		"name":   "Jane",
+		"family": []interface{}{map[string]interface{}{"name": "John"}},
+	}
+	if !reflect.DeepEqual(identify.Traits, expected) {
+		t.Errorf("expected %v, got %v", expected, identify.Traits)
+	}
+	if !reflect.DeepEqual(identify.Context, map[string]interface{}{"traits": map[string]interface{}{}}) {
+		t.Errorf("expected the context to be redacted, got %v", identify.Context)
+	}
+	if _, ok := traits["SSN"]; !ok {
+		t.Error("expected the traits of the caller to be left alone")
+	}
+
+	nested := Traits{"email": "jane@example.com", "ssn": "078-05-1120"}
+	identify = &Identify{UserId: "123456", Traits: Traits{
+		"nested": Properties{"ssn": "078-05-1120", "plan": "free"},
+		"labels": map[string]string{"dob": "1970-01-01", "team": "billing"},
+		"scores": []map[string]int{{"ssn": 1, "rank": 2}},
+	}, Context: map[string]interface{}{"traits": nested}}
+	if _, err := client.prepare(identify); err != nil {
+		t.Fatal(err)
+	}
+
+	expected = map[string]interface{}{
+		"nested": Properties{"plan": "free"},
+		"labels": map[string]string{"team": "billing"},
+		"scores": []map[string]int{{"rank": 2}},
+	}
+	if !reflect.DeepEqual(identify.Traits, expected) {
+		t.Errorf("expected the maps of other types to be redacted, got %v", identify.Traits)
+	}
+	if v := identify.Context["traits"]; !reflect.DeepEqual(v, Traits{"email": "jane@example.com"}) {
+		t.Errorf("expected the traits of the context to be redacted, got %#v", v)
+	}
+	if _, ok := nested["ssn"]; !ok {
+		t.Error("expected the traits of the caller to be left alone")
+	}
+
+	defaults := pausedClient(10)
+	defaults.RedactKeys = []string{"ssn"}
+	defaults.DefaultContext = map[string]interface{}{
+		"app": map[string]interface{}{"version": "1.2.3", "ssn": "078-05-1120"},
+		"ssn": "078-05-1120",
+	}
+	defer defaults.Close()
+	defaults.Track(&Track{Event: "Download", UserId: "123456"})
+
+	ctx := queued(defaults)[0].(*Track).Context
+	if _, ok := ctx["ssn"]; ok {
+		t.Errorf("expected the keys of the DefaultContext to be redacted, got %v", ctx)
+	}
+	if app := ctx["app"]; !reflect.DeepEqual(app, map[string]interface{}{"version": "1.2.3"}) {
+		t.Errorf("expected the maps of the DefaultContext to be redacted, got %v", app)
+	}
+	if _, ok := defaults.DefaultContext["ssn"]; !ok {
+		t.Error("expected the DefaultContext to be left alone")
+	}
+	defaults.Resume()
+}
+
+func TestMaxQueuedBytes(t *testing.T) {
+	client := pausedClient(10)
+	client.MaxQueuedBytes = 1
+	client.OverflowPolicy = DropNewest
+
+	// a message larger than the limit is let into the empty queue.
+	if err := client.Enqueue(&Track{Event: "Download", UserId: "123456"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Enqueue(&Track{Event: "Download", UserId: "123456"}); err != ErrQueueFull {
+		t.Errorf("expected ErrQueueFull, got %v", err)
+	}
+
+	queued(client)
+	if err := client.Enqueue(&Track{Event: "Download", UserId: "123456"}); err != nil {
+		t.Errorf("expected room for the message once one left the queue, got %v", err)
+	}
+
+	client.OverflowPolicy = BlockOnFull
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := client.EnqueueContext(ctx, &Track{Event: "Download", UserId: "123456"}); err != context.DeadlineExceeded {
+		t.Errorf("expected the message to block until the deadline, got %v", err)
+	}
+}
+
+func TestFlushContext(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Interval = time.Hour
+	defer client.Close()
+
+	if err := client.FlushContext(context.Background()); err != nil {
+		t.Errorf("expected flushing an empty queue to succeed, got %v", err)
+	}
+
+	if err := client.Track(&Track{Event: "Download", UserId: "123456"}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := client.FlushContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	close(release)
+	if err := client.FlushContext(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	reset := &url.Error{Op: "Post", URL: "https://api.segment.io/v1/batch", Err: &net.OpError{
+		Op:  "read",
+		Net: "tcp",
+		Err: os.NewSyscallError("read", syscall.ECONNRESET),
+	}}
+
+	tests := []struct {
+		err        error
+		statusCode int
+		retryable  bool
+	}{
+		{nil, http.StatusInternalServerError, true},
+		{nil, http.StatusBadGateway, true},
+		{nil, http.StatusTooManyRequests, true},
+		{nil, http.StatusBadRequest, false},
+		{nil, http.StatusUnauthorized, false},
+		{fmt.Errorf("error sending request: %w", reset), 0, true},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, 0, true},
+		{&url.Error{Op: "Post", Err: io.EOF}, 0, true},
+		{io.ErrUnexpectedEOF, 0, true},
+		{context.DeadlineExceeded, 0, true},
+		{&net.DNSError{Err: "server misbehaving", IsTemporary: true}, 0, true},
+		{&net.DNSError{Err: "no such host", IsNotFound: true}, 0, false},
+		{context.Canceled, 0, false},
+		{errors.New("unsupported protocol scheme"), 0, false},
+		{nil, 0, false},
+	}
+
+	for _, test := range tests {
+		if r := isRetryable(test.err, test.statusCode); r != test.retryable {
+			t.Errorf("isRetryable(%v, %d) = %t, expected %t", test.err, test.statusCode, r, test.retryable)
+		}
+	}
+}
+
+func TestRetryConnectionReset(t *testing.T) {
+	var attempts int32
+	client := New("h97jamjwbh")
+	client.Sync = true
+	client.RetryAfter = func(int) time.Duration { return 0 }
+	client.HTTPClient = &http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			if atomic.AddInt32(&attempts, 1) == 1 {
+				return nil, &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+			}
+			return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+		}),
+	}
+
+	if err := client.Track(&Track{Event: "Download", UserId: "123456"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&attempts); n != 2 {
+		t.Errorf("expected the reset request to be retried, got %d attempts", n)
+	}
+}
+
+type warningCallback struct {
+	callback
+	warnings [][2]int
+}
+
+func (c *warningCallback) QueueWarning(depth, capacity int) {
+	c.Lock()
+	defer c.Unlock()
+	c.warnings = append(c.warnings, [2]int{depth, capacity})
+}
+
+func TestQueueWarnThreshold(t *testing.T) {
+	now := mockTime()
+	cb := new(warningCallback)
+	client := pausedClient(4)
+	client.Callback = cb
+	client.QueueWarnThreshold = 0.5
+	client.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		client.Track(&Track{Event: "Download", UserId: "123456"})
+	}
+	now = now.Add(time.Minute)
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+
+	expected := [][2]int{{2, 4}, {4, 4}}
+	if !reflect.DeepEqual(cb.warnings, expected) {
+		t.Errorf("expected warnings %v, got %v", expected, cb.warnings)
+	}
+}
+
+func TestWriteBatch(t *testing.T) {
+	raw := json.RawMessage(`{"event":"Replayed"}`)
+	batch := &Batch{
+		Context:  map[string]interface{}{"ip": "1.2.3.4"},
+		Messages: []interface{}{&Track{Event: "Download", UserId: "123456"}, &raw},
+		Message:  Message{MessageId: "I'm unique", SentAt: "2009-11-10T23:00:00+0000"},
+	}
+
+	var buf bytes.Buffer
+	if err := writeBatch(&buf, batch); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(batch)
+
+	var streamed, marshalled interface{}
+	if err := json.Unmarshal(buf.Bytes(), &streamed); err != nil {
+		t.Fatalf("invalid streamed batch %s: %s", buf.Bytes(), err)
+	}
+	json.Unmarshal(b, &marshalled)
+	if !reflect.DeepEqual(streamed, marshalled) {
+		t.Errorf("expected %s, got %s", b, buf.Bytes())
+	}
+}
+
+func TestStreamedRetries(t *testing.T) {
+	var attempts int32
+	var bodies [][]byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength != -1 {
+			t.Errorf("expected a compressed body of unknown length, got %d", r.ContentLength)
+		}
+		z, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		b, _ := ioutil.ReadAll(z)
+		bodies = append(bodies, b)
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Sync = true
+	client.Gzip = true
+	client.RetryAfter = func(int) time.Duration { return 0 }
+
+	if err := client.Track(&Track{Event: "Download", UserId: "123456"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(bodies) != 2 || len(bodies[0]) == 0 || !bytes.Equal(bodies[0], bodies[1]) {
+		t.Errorf("expected the batch to be encoded again for the retry, got %q", bodies)
+	}
+}
+
+func TestNewFromEnv(t *testing.T) {
+	t.Setenv("SEGMENT_WRITE_KEY", "h97jamjwbh")
+	t.Setenv("SEGMENT_ENDPOINT", "https://example.com")
+	t.Setenv("SEGMENT_BATCH_SIZE", "50")
+	t.Setenv("SEGMENT_FLUSH_INTERVAL", "10s")
+	t.Setenv("SEGMENT_GZIP", "true")
+
+	client, err := NewFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.key != "h97jamjwbh" || client.Endpoint != "https://example.com" || client.Size != 50 || client.Interval != 10*time.Second || !client.Gzip {
+		t.Errorf("unexpected client configuration %+v", client)
+	}
+	if client.MaxQueueSize != 0 || client.Verbose {
+		t.Error("expected unset variables to keep their defaults")
+	}
+
+	t.Setenv("SEGMENT_BATCH_SIZE", "fifty")
+	if _, err := NewFromEnv(); err == nil || !strings.Contains(err.Error(), "SEGMENT_BATCH_SIZE") {
+		t.Errorf("expected an invalid SEGMENT_BATCH_SIZE error, got %v", err)
+	}
+
+	var configErr *ConfigError
+	t.Setenv("SEGMENT_WRITE_KEY", "")
+	if _, err := NewFromEnv(); !errors.As(err, &configErr) {
+		t.Errorf("expected a ConfigError for a missing write key, got %v", err)
+	}
+}
+
+func TestFilteredEvents(t *testing.T) {
+	cb := new(dropCallback)
+	client := pausedClient(10)
+	client.Callback = cb
+	client.AllowedEvents = []string{"Download", "Upload"}
+	client.BlockedEvents = []string{"Upload"}
+
+	for _, event := range []string{"Download", "Upload", "Delete"} {
+		if err := client.Track(&Track{Event: event, UserId: "123456"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client.Identify(&Identify{UserId: "123456"})
+
+	expected := []DropReason{DropFiltered, DropFiltered}
+	if !reflect.DeepEqual(cb.drops, expected) {
+		t.Errorf("expected drops %v, got %v", expected, cb.drops)
+	}
+	if n := client.Stats().QueueLength; n != 2 {
+		t.Errorf("expected the allowed track and the identify to be queued, got %d msgs", n)
+	}
+}
+
+type logEntry struct {
+	level  string
+	msg    string
+	fields map[string]interface{}
+}
+
+type structuredLogger struct {
+	sync.Mutex
+	entries []logEntry
+}
+
+func (l *structuredLogger) Log(level, msg string, fields map[string]interface{}) {
+	l.Lock()
+	defer l.Unlock()
+	l.entries = append(l.entries, logEntry{level, msg, fields})
+}
+
+func TestStructuredLogger(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	logger := new(structuredLogger)
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Sync = true
+	client.Verbose = true
+	client.StructuredLogger = logger
+	client.RetryAfter = func(int) time.Duration { return 0 }
+
+	if err := client.Track(&Track{Event: "Download", UserId: "123456"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var retried, succeeded bool
+	for _, entry := range logger.entries {
+		if entry.level != "debug" {
+			t.Errorf("expected debug entries, got %q: %s", entry.level, entry.msg)
+		}
+		if entry.fields["retry"] == 1 && entry.fields["batch_size"] == 1 {
+			retried = true
+		}
+		if entry.fields["status"] == http.StatusOK {
+			succeeded = true
+		}
+	}
+	if !retried || !succeeded {
+		t.Errorf("expected retry and response fields, got %+v", logger.entries)
+	}
+}
+
+func TestFreezeTimestampAtEnqueue(t *testing.T) {
+	for _, freeze := range []bool{true, false} {
+		now := mockTime()
+		body, server := mockServer()
+
+		client := New("h97jamjwbh")
+		client.Endpoint = server.URL
+		client.Interval = time.Hour
+		client.FreezeTimestampAtEnqueue = freeze
+		client.now = func() time.Time { return now }
+
+		client.Track(&Track{Event: "Download", UserId: "123456"})
+		enqueued := timestamp(now)
+		now = now.Add(time.Minute)
+		client.Flush()
+		client.Close()
+		server.Close()
+
+		var batch struct {
+			SentAt string
+			Batch  []struct{ Timestamp string }
+		}
+		if err := json.Unmarshal(<-body, &batch); err != nil {
+			t.Fatal(err)
+		}
+		expected := enqueued
+		if !freeze {
+			expected = batch.SentAt
+		}
+		if batch.SentAt != timestamp(now) || batch.Batch[0].Timestamp != expected {
+			t.Errorf("freeze %t: expected timestamp %s and sentAt %s, got %+v", freeze, expected, timestamp(now), batch)
+		}
+	}
+}
+
+func TestAliasValidation(t *testing.T) {
+	client := pausedClient(10)
+
+	tests := []struct {
+		alias *Alias
+		field string
+	}{
+		{&Alias{PreviousId: "a1b2c3"}, "userId"},
+		{&Alias{UserId: "123456"}, "previousId"},
+		{&Alias{}, "userId"},
+	}
+	for _, test := range tests {
+		err := client.Alias(test.alias)
+		if e, ok := err.(*FieldError); !ok || e.Field != test.field {
+			t.Errorf("expected a %s FieldError, got %v", test.field, err)
+		}
+	}
+	if n := client.Stats().QueueLength; n != 0 {
+		t.Errorf("expected invalid aliases not to be queued, got %d msgs", n)
+	}
+
+	if err := client.Alias(&Alias{PreviousId: "a1b2c3", UserId: "123456"}); err != nil {
+		t.Error(err)
+	}
+	if n := client.Stats().QueueLength; n != 1 {
+		t.Errorf("expected the valid alias to be queued, got %d msgs", n)
+	}
+}
+
+func TestShouldRetry(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusTeapot)
+			w.Write([]byte("warming up"))
+		}
+	}))
+	defer server.Close()
+
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Sync = true
+	client.RetryAfter = func(int) time.Duration { return 0 }
+	client.ShouldRetry = func(res *http.Response, err error) bool {
+		if res == nil {
+			return false
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode == http.StatusTeapot && string(body) == "warming up"
+	}
+
+	if err := client.Track(&Track{Event: "Download", UserId: "123456"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&attempts); n != 2 {
+		t.Errorf("expected the rejected request to be retried, got %d attempts", n)
+	}
+
+	if client.retryable(&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}) {
+		t.Error("expected ShouldRetry to override the classification of network errors")
+	}
+}
+
+func TestEnqueueAwait(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) > 1 {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Interval = time.Hour
+	defer client.Close()
+
+	sent := client.EnqueueAwait(&Track{Event: "Download", UserId: "123456"})
+	client.Flush()
+	if err := <-sent; err != nil {
+		t.Errorf("expected the message to be sent, got %v", err)
+	}
+
+	rejected := client.EnqueueAwait(&Track{Event: "Download", UserId: "123456"})
+	client.Flush()
+	if err, ok := (<-rejected).(*APIError); !ok || err.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected a rejection, got %v", err)
+	}
+
+	if err := <-client.EnqueueAwait(&Track{Event: "Download"}); err != errMissingIdentity {
+		t.Errorf("expected %v, got %v", errMissingIdentity, err)
+	}
+
+	client.BlockedEvents = []string{"Upload"}
+	if err := <-client.EnqueueAwait(&Track{Event: "Upload", UserId: "123456"}); !errors.Is(err, ErrDropped) {
+		t.Errorf("expected %v, got %v", ErrDropped, err)
+	}
+
+	full := pausedClient(1)
+	full.OverflowPolicy = DropNewest
+	defer full.Close()
+	full.Track(&Track{Event: "Download", UserId: "123456"})
+	if err := <-full.EnqueueAwait(&Track{Event: "Download", UserId: "123456"}); !errors.Is(err, ErrQueueFull) || !errors.Is(err, ErrDropped) {
+		t.Errorf("expected %v, got %v", ErrQueueFull, err)
+	}
+	full.Resume()
+}
+
+func TestEnqueueWithCallback(t *testing.T) {
+	body, server := mockServer()
+	defer server.Close()
+
+	global, critical := &callback{}, &callback{}
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Interval = time.Hour
+	client.Callback = global
+	defer client.Close()
+
+	track := &Track{Event: "Order Completed", UserId: "123456"}
+	if err := client.EnqueueWithCallback(track, critical); err != nil {
+		t.Fatal(err)
+	}
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+	client.Flush()
+	<-body
+
+	critical.Lock()
+	if len(critical.success) != 1 || critical.success[0] != track {
+		t.Errorf("expected the message to be reported to its callback, got %v", critical.success)
+	}
+	critical.Unlock()
+	global.Lock()
+	if len(global.success) != 2 {
+		t.Errorf("expected both messages to be reported to the client callback, got %v", global.success)
+	}
+	global.Unlock()
+}
+
+func TestEnqueueWithCallbackError(t *testing.T) {
+	client := pausedClient(1)
+	client.OverflowPolicy = DropNewest
+	defer client.Close()
+
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+	critical := &callback{}
+	if err := client.EnqueueWithCallback(&Track{Event: "Order Completed", UserId: "123456"}, critical); err != ErrQueueFull {
+		t.Errorf("expected %v, got %v", ErrQueueFull, err)
+	}
+	if len(critical.failure) != 0 {
+		t.Errorf("expected the returned error not to be reported to the callback too, got %v", critical.errs)
+	}
+
+	client.BlockedEvents = []string{"Upload"}
+	if err := client.EnqueueWithCallback(&Track{Event: "Upload", UserId: "123456"}, critical); err != nil {
+		t.Errorf("expected no error for a filtered message, got %v", err)
+	}
+	if len(critical.failure) != 1 || !errors.Is(critical.errs[0], ErrDropped) {
+		t.Errorf("expected the filtered message to be reported to the callback, got %v", critical.errs)
+	}
+	client.Resume()
+}
+
+func TestMaxPropertyBytes(t *testing.T) {
+	cb := new(dropCallback)
+	client := pausedClient(10)
+	client.Callback = cb
+	client.MaxPropertyBytes = 32
+
+	err := client.Track(&Track{Event: "Download", UserId: "123456", Properties: map[string]interface{}{
+		"graph": strings.Repeat("x", 64),
+	}})
+	if e, ok := err.(*FieldError); !ok || e.Field != "properties" {
+		t.Errorf("expected a properties FieldError, got %v", err)
+	}
+	err = client.Identify(&Identify{UserId: "123456", Traits: map[string]interface{}{
+		"graph": strings.Repeat("x", 64),
+	}})
+	if e, ok := err.(*FieldError); !ok || e.Field != "traits" {
+		t.Errorf("expected a traits FieldError, got %v", err)
+	}
+	if err := client.Track(&Track{Event: "Download", UserId: "123456", Properties: map[string]interface{}{"plan": "free"}}); err != nil {
+		t.Error(err)
+	}
+
+	expected := []DropReason{DropInvalid, DropInvalid}
+	if !reflect.DeepEqual(cb.drops, expected) {
+		t.Errorf("expected drops %v, got %v", expected, cb.drops)
+	}
+	if n := client.Stats().QueueLength; n != 1 {
+		t.Errorf("expected only the small message to be queued, got %d msgs", n)
+	}
+}
+
+func TestDefaultContext(t *testing.T) {
+	client := pausedClient(10)
+	client.DefaultContext = map[string]interface{}{"app": map[string]interface{}{"version": "1.2.3"}, "locale": "en-US"}
+
+	client.Group(&Group{GroupId: "acme", UserId: "123456"})
+	client.Track(&Track{Event: "Download", UserId: "123456", Context: map[string]interface{}{"locale": "fr-FR"}})
+
+	msgs := queued(client)
+	group := msgs[0].(*Group)
+	if group.Context["app"] == nil || group.Context["locale"] != "en-US" || group.Context["library"] == nil {
+		t.Errorf("expected the default context and the library, got %v", group.Context)
+	}
+	track := msgs[1].(*Track)
+	if track.Context["app"] == nil || track.Context["locale"] != "fr-FR" {
+		t.Errorf("expected the context of the message to take precedence, got %v", track.Context)
+	}
+	if client.DefaultContext["library"] != nil {
+		t.Error("expected the default context to be left alone")
+	}
+}
+
+func TestValidateWriteKey(t *testing.T) {
+	for _, key := range []string{"h97jamjwbh", "aGVsbG8gd29ybGQ=", "a-b_c"} {
+		if err := ValidateWriteKey(key); err != nil {
+			t.Errorf("expected %q to be valid, got %v", key, err)
+		}
+	}
+	for _, key := range []string{"", "h97jamjwbh\n", " h97jamjwbh", "h97:jamjwbh"} {
+		if err := ValidateWriteKey(key); err == nil {
+			t.Errorf("expected %q to be invalid", key)
+		}
+	}
+}
+
+func TestInvalidWriteKey(t *testing.T) {
+	for _, key := range []string{"", " h97jamjwbh"} {
+		client := New(key)
+		client.ValidateWriteKey = key != ""
+		client.Logger = log.New(ioutil.Discard, "", 0)
+
+		var configErr *ConfigError
+		if err := client.Track(&Track{Event: "Download", UserId: "123456"}); !errors.As(err, &configErr) {
+			t.Errorf("expected the write key %q to be rejected with a ConfigError, got %v", key, err)
+		}
+		if n := client.Stats().QueueLength; n != 0 {
+			t.Errorf("expected nothing to be queued, got %d", n)
+		}
+	}
+
+	client := New("h97jamjwbh\n")
+	client.DryRun = true
+	client.DryRunOutput = ioutil.Discard
+	if err := client.Track(&Track{Event: "Download", UserId: "123456"}); err != nil {
+		t.Errorf("expected the format of the write key not to be checked by default, got %v", err)
+	}
+	client.Close()
+
+	client = New("")
+	client.WriteKeyFunc = func() string { return "h97jamjwbh" }
+	client.DryRun = true
+	client.DryRunOutput = ioutil.Discard
+	defer client.Close()
+
+	if err := client.Track(&Track{Event: "Download", UserId: "123456"}); err != nil {
+		t.Errorf("expected the key from WriteKeyFunc to be used, got %v", err)
+	}
+}
+
+func TestPriorityEviction(t *testing.T) {
+	events := func(msgs []interface{}) []string {
+		var events []string
+		for _, msg := range msgs {
+			events = append(events, msg.(*Track).Event)
+		}
+		return events
+	}
+
+	for _, policy := range []OverflowPolicy{BlockOnFull, DropNewest, DropOldest} {
+		client := pausedClient(2)
+		client.OverflowPolicy = policy
+		client.EnqueuePriority(&Track{Event: "Noise", UserId: "123456"}, PriorityLow)
+		client.EnqueuePriority(&Track{Event: "Debug", UserId: "123456"}, PriorityNormal)
+
+		if err := client.Track(&Track{Event: "Download", UserId: "123456"}); err != nil {
+			t.Errorf("expected the low priority message to be evicted with policy %d, got %v", policy, err)
+		}
+		if got, want := events(queued(client)), []string{"Debug", "Download"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %v to be queued with policy %d, got %v", want, policy, got)
+		}
+		client.Resume()
+		client.Close()
+	}
+
+	client := pausedClient(2)
+	client.OverflowPolicy = DropOldest
+	client.EnqueuePriority(&Track{Event: "Signup", UserId: "123456"}, PriorityHigh)
+	client.Track(&Track{Event: "Debug", UserId: "123456"})
+	client.EnqueuePriority(&Track{Event: "Purchase", UserId: "123456"}, PriorityHigh)
+	if err := client.Track(&Track{Event: "Download", UserId: "123456"}); err != ErrQueueFull {
+		t.Errorf("expected high priority messages not to be evicted for normal ones, got %v", err)
+	}
+	if got, want := events(queued(client)), []string{"Signup", "Purchase"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v to be queued, got %v", want, got)
+	}
+	client.Resume()
+	client.Close()
+}
+
+func TestPriorityQueueSize(t *testing.T) {
+	client := pausedClient(2)
+	client.OverflowPolicy = DropNewest
+	defer client.Close()
+
+	client.EnqueuePriority(&Track{Event: "Signup", UserId: "123456"}, PriorityHigh)
+	client.Track(&Track{Event: "Debug", UserId: "123456"})
+	if err := client.EnqueuePriority(&Track{Event: "Purchase", UserId: "123456"}, PriorityHigh); err != ErrQueueFull {
+		t.Errorf("expected high priority messages to count against the MaxQueueSize, got %v", err)
+	}
+	if err := client.Track(&Track{Event: "Download", UserId: "123456"}); err != ErrQueueFull {
+		t.Errorf("expected a full queue to reject normal messages, got %v", err)
+	}
+	if n := client.Stats().QueueLength; n != 2 {
+		t.Errorf("expected 2 queued messages, got %d", n)
+	}
+	client.Resume()
+}
+
+// Close must drain the queues together: an enqueuer blocked on the normal
+// queue holds up the closing of the urgent one.
+func TestCloseWhileBlocked(t *testing.T) {
+	body, server := mockServer()
+	defer server.Close()
+
+	client := pausedClient(1)
+	client.Endpoint = server.URL
+	client.Interval = time.Hour
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+
+	blocked := make(chan error)
+	go func() { blocked <- client.Track(&Track{Event: "Download", UserId: "123456"}) }()
+	for client.Stats().QueueLength != 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	closed := make(chan error)
+	go func() { closed <- client.Close() }()
+	go func() {
+		for range body {
+		}
+	}()
+
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Close not to deadlock with a blocked enqueuer")
+	}
+	if err := <-blocked; err != nil {
+		t.Errorf("expected the blocked message to be queued, got %v", err)
+	}
+}
+
+func TestCompressionStats(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	for _, encoding := range []Encoding{EncodingJSON, EncodingMsgpack} {
+		client := New("h97jamjwbh")
+		client.Endpoint = server.URL
+		client.Sync = true
+		client.Gzip = true
+		client.Encoding = encoding
+
+		client.Track(&Track{Event: "Download", UserId: "123456", Properties: map[string]interface{}{
+			"description": strings.Repeat("compressible ", 100),
+		}})
+
+		stats := client.Stats()
+		if stats.CompressedBytes == 0 || stats.CompressedBytes >= stats.UncompressedBytes {
+			t.Errorf("encoding %d: expected the batch to be compressed, got %d of %d bytes", encoding, stats.CompressedBytes, stats.UncompressedBytes)
+		}
+	}
+}
+
+type streamTransport struct {
+	sync.Mutex
+	connected bool
+	batches   [][]byte
+}
+
+func (s *streamTransport) Send(ctx context.Context, batch io.Reader) error {
+	s.Lock()
+	defer s.Unlock()
+	if !s.connected {
+		return fmt.Errorf("stream disconnected")
+	}
+	b, err := ioutil.ReadAll(batch)
+	if err != nil {
+		return err
+	}
+	s.batches = append(s.batches, b)
+	return nil
+}
+
+func TestStreamTransport(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+	}))
+	defer server.Close()
+
+	transport := &streamTransport{connected: true}
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Sync = true
+	client.StreamTransport = transport
+
+	if err := client.Track(&Track{Event: "Download", UserId: "123456"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(transport.batches) != 1 || !bytes.Contains(transport.batches[0], []byte(`"Download"`)) {
+		t.Errorf("expected the batch to be streamed, got %q", transport.batches)
+	}
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Errorf("expected no batch request, got %d", n)
+	}
+
+	transport.connected = false
+	if err := client.Track(&Track{Event: "Download", UserId: "123456"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("expected a fallback batch request, got %d", n)
+	}
+}
+
+func TestPressure(t *testing.T) {
+	var fail int32 = 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&fail) == 1 {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	pressure := make(chan PressureEvent, 10)
+	client := pausedClient(2)
+	client.Endpoint = server.URL
+	client.Interval = time.Hour
+	client.Pressure = pressure
+
+	for i := 0; i < 2; i++ {
+		client.Track(&Track{Event: "Download", UserId: "123456"})
+	}
+	if event := <-pressure; event.QueueLength != 2 || event.QueueCapacity != 2 || event.Err != nil {
+		t.Errorf("expected a full queue event, got %+v", event)
+	}
+
+	// uploads fail twice in a row, but only the first failure is reported.
+	msgs := queued(client)
+	client.Resume()
+	client.send(context.Background(), server.URL, msgs[:1])
+	client.send(context.Background(), server.URL, msgs[1:])
+	if event := <-pressure; event.Err == nil {
+		t.Errorf("expected a failing upload event, got %+v", event)
+	}
+	select {
+	case event := <-pressure:
+		t.Errorf("expected no more events, got %+v", event)
+	default:
+	}
+
+	atomic.StoreInt32(&fail, 0)
+	client.send(context.Background(), server.URL, []interface{}{&Track{Event: "Download", UserId: "123456"}})
+	atomic.StoreInt32(&fail, 1)
+	client.send(context.Background(), server.URL, []interface{}{&Track{Event: "Download", UserId: "123456"}})
+	if event := <-pressure; event.Err == nil {
+		t.Errorf("expected failing uploads to be reported again after a success, got %+v", event)
+	}
+}
+
+func TestSetIntervalAndBatchSize(t *testing.T) {
+	body, server := mockServer()
+	defer server.Close()
+
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Interval = time.Hour
+	defer client.Close()
+
+	if err := client.SetBatchSize(0); err == nil {
+		t.Error("expected an error for a batch size of 0")
+	}
+	if err := client.SetInterval(-time.Second); err == nil {
+		t.Error("expected an error for a negative interval")
+	}
+
+	if err := client.SetBatchSize(2); err != nil {
+		t.Fatal(err)
+	}
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+	select {
+	case <-body:
+	case <-time.After(time.Second):
+		t.Fatal("expected the batch to be sent once it had 2 messages")
+	}
+
+	if err := client.SetInterval(10 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	client.Track(&Track{Event: "Download", UserId: "123456"})
+	select {
+	case <-body:
+	case <-time.After(time.Second):
+		t.Fatal("expected the message to be sent at the new interval")
+	}
+}
+
+func TestIdempotent(t *testing.T) {
+	var keys []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+		if len(keys) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Idempotent = true
+	client.RetryAfter = func(int) time.Duration { return 0 }
+
+	a := &Track{Event: "Download", UserId: "123456", Message: Message{MessageId: "a"}}
+	b := &Track{Event: "Download", UserId: "123456", Message: Message{MessageId: "b"}}
+	if err := client.send(context.Background(), server.URL, []interface{}{a, b}); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0] == "" || keys[0] != keys[1] {
+		t.Errorf("expected the same key for the retry, got %q", keys)
+	}
+
+	reordered := idempotencyKey(&Batch{Messages: []interface{}{b, a}})
+	if reordered != keys[0] {
+		t.Errorf("expected the key not to depend on the order of the messages, got %q and %q", reordered, keys[0])
+	}
+	raw := json.RawMessage(`{}`)
+	if key := idempotencyKey(&Batch{Messages: []interface{}{a, &raw}, Message: Message{MessageId: "batch"}}); key != "batch" {
+		t.Errorf("expected the batch id for messages without ids, got %q", key)
+	}
+}
+
+func TestPartialFailureSupport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"results": [{"status": 200}, {"status": 400, "message": "invalid event"}]}`))
+	}))
+	defer server.Close()
+
+	cb := new(callback)
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Callback = cb
+	client.PartialFailureSupport = true
+
+	accepted := &Track{Event: "Download", UserId: "123456"}
+	rejected := &Track{Event: "Download", UserId: "123456"}
+	if err := client.send(context.Background(), server.URL, []interface{}{accepted, rejected}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cb.success) != 1 || cb.success[0] != accepted {
+		t.Errorf("expected the accepted message to succeed, got %v", cb.success)
+	}
+	if len(cb.failure) != 1 || cb.failure[0] != rejected {
+		t.Errorf("expected the rejected message to fail, got %v", cb.failure)
+	} else if err, ok := cb.errs[0].(*APIError); !ok || err.StatusCode != 400 || err.Body != "invalid event" {
+		t.Errorf("expected the error of the message, got %v", cb.errs[0])
+	}
+	if stats := client.Stats(); stats.MessagesSent != 1 || stats.MessagesDropped != 1 {
+		t.Errorf("expected 1 message sent and 1 dropped, got %+v", stats)
+	}
+}
+
+func TestWarmUp(t *testing.T) {
+	var methods []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}))
+	defer server.Close()
+
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	if err := client.WarmUp(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(methods, []string{"HEAD"}) {
+		t.Errorf("expected a HEAD request, got %v", methods)
+	}
+
+	client.Endpoint = "http://127.0.0.1:0"
+	client.Logger = log.New(ioutil.Discard, "", 0)
+	if err := client.WarmUp(context.Background()); err == nil {
+		t.Error("expected an error for an unreachable endpoint")
+	}
+}
+
+func TestEnqueuePriority(t *testing.T) {
+	var batches [][]string
+	var mtx sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch struct{ Batch []struct{ Event string } }
+		json.NewDecoder(r.Body).Decode(&batch)
+		var events []string
+		for _, msg := range batch.Batch {
+			events = append(events, msg.Event)
+		}
+		mtx.Lock()
+		batches = append(batches, events)
+		mtx.Unlock()
+	}))
+	defer server.Close()
+
+	client := New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Interval = time.Hour
+	client.MaxQueueSize = 3
+	client.WorkerCount = 1
+	client.Pause()
+
+	for _, event := range []string{"Debug", "Debug"} {
+		if err := client.EnqueuePriority(&Track{Event: event, UserId: "123456"}, PriorityNormal); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := client.EnqueuePriority(&Track{Event: "Signup", UserId: "123456"}, PriorityHigh); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.EnqueuePriority(&Track{Event: "Noise", UserId: "123456"}, PriorityLow); err != ErrQueueFull {
+		t.Errorf("expected low priority messages to be dropped from a full queue, got %v", err)
+	}
+
+	client.Resume()
+	client.Flush()
+	client.Close()
+
+	expected := [][]string{{"Signup"}, {"Debug", "Debug"}}
+	if !reflect.DeepEqual(batches, expected) {
+		t.Errorf("expected batches %v, got %v", expected, batches)
+	}
+}
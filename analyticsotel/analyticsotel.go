@@ -0,0 +1,83 @@
+// Package analyticsotel traces the batch uploads of an analytics.Client with
+// OpenTelemetry.
+package analyticsotel
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/segmentio/analytics-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// SpanName is the name of the span started for every batch.
+const SpanName = "analytics.flush"
+
+// Instrument client to start a span for every batch it uploads, with the
+// tracer of provider or the global one if nil. The span is the parent of the
+// upload requests, and is propagated in their headers with the global
+// propagator. The previous client.TraceBatch, if any, is still called, within
+// the span.
+func Instrument(client *analytics.Client, provider trace.TracerProvider) {
+	if provider == nil {
+		provider = otel.GetTracerProvider()
+	}
+	tracer := provider.Tracer("github.com/segmentio/analytics-go")
+
+	previous := client.TraceBatch
+	client.TraceBatch = func(ctx context.Context, n, size int) (context.Context, func(int, error)) {
+		ctx, span := tracer.Start(ctx, SpanName,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				attribute.Int("analytics.batch.messages", n),
+				attribute.Int("analytics.batch.bytes", size),
+			),
+		)
+		end := func(int, error) {}
+		if previous != nil {
+			ctx, end = previous(ctx, n, size)
+		}
+		return ctx, func(retries int, err error) {
+			end(retries, err)
+			span.SetAttributes(attribute.Int("analytics.batch.retries", retries))
+			if e, ok := err.(*analytics.APIError); ok {
+				span.SetAttributes(attribute.Int("http.status_code", e.StatusCode))
+			}
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+			} else {
+				span.SetStatus(codes.Ok, "")
+			}
+			span.End()
+		}
+	}
+
+	// the settings of Client are moved to HTTPClient, they can't both be set.
+	httpClient := client.Client
+	if client.HTTPClient != nil {
+		httpClient = *client.HTTPClient
+	}
+	client.Client = http.Client{}
+	transport := httpClient.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	httpClient.Transport = propagator{transport}
+	client.HTTPClient = &httpClient
+}
+
+// Transport injecting the span context of requests in their headers.
+type propagator struct {
+	transport http.RoundTripper
+}
+
+func (p propagator) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	otel.GetTextMapPropagator().Inject(r.Context(), propagation.HeaderCarrier(r.Header))
+	return p.transport.RoundTrip(r)
+}
@@ -0,0 +1,57 @@
+package analyticsotel
+
+import "context"
+import "net/http/httptest"
+import "net/http"
+import "testing"
+
+import "github.com/segmentio/analytics-go"
+import "go.opentelemetry.io/otel"
+import "go.opentelemetry.io/otel/attribute"
+import "go.opentelemetry.io/otel/propagation"
+import sdktrace "go.opentelemetry.io/otel/sdk/trace"
+import "go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+func TestInstrument(t *testing.T) {
+	headers := make(chan http.Header, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+	}))
+	defer server.Close()
+
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	client := analytics.New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Sync = true
+	traced := 0
+	client.TraceBatch = func(ctx context.Context, n, size int) (context.Context, func(int, error)) {
+		return ctx, func(int, error) { traced++ }
+	}
+	Instrument(client, provider)
+
+	if err := client.Track(&analytics.Track{Event: "Download", UserId: "123456"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if traced != 1 {
+		t.Errorf("expected the previous TraceBatch to be called once, got %d", traced)
+	}
+	if (<-headers).Get("Traceparent") == "" {
+		t.Error("expected the span to be propagated in the request headers")
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 || spans[0].Name != SpanName {
+		t.Fatalf("expected a single %s span, got %v", SpanName, spans)
+	}
+	attributes := map[attribute.Key]attribute.Value{}
+	for _, kv := range spans[0].Attributes {
+		attributes[kv.Key] = kv.Value
+	}
+	if attributes["analytics.batch.messages"].AsInt64() != 1 || attributes["analytics.batch.retries"].AsInt64() != 0 {
+		t.Errorf("unexpected span attributes %v", spans[0].Attributes)
+	}
+}
@@ -0,0 +1,89 @@
+// Package analyticsprom exports the stats of an analytics.Client as
+// Prometheus metrics.
+package analyticsprom
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/segmentio/analytics-go"
+)
+
+// Collector of the metrics of a client, to be registered with a
+// prometheus.Registerer.
+type Collector struct {
+	client *analytics.Client
+
+	enqueued *prometheus.Desc
+	sent     *prometheus.Desc
+	batches  *prometheus.Desc
+	dropped  *prometheus.Desc
+	retried  *prometheus.Desc
+	queued   *prometheus.Desc
+	inFlight *prometheus.Desc
+	latency  prometheus.Histogram
+}
+
+var _ prometheus.Collector = (*Collector)(nil)
+
+// New returns a collector of the metrics of client. It sets client.TraceBatch,
+// calling the previous one if any, to observe the flush latency, so it must
+// be created before the client is used.
+func New(client *analytics.Client) *Collector {
+	c := &Collector{
+		client:   client,
+		enqueued: prometheus.NewDesc("analytics_messages_enqueued_total", "Messages accepted by the client.", nil, nil),
+		sent:     prometheus.NewDesc("analytics_messages_sent_total", "Messages uploaded successfully.", nil, nil),
+		batches:  prometheus.NewDesc("analytics_batches_sent_total", "Batches uploaded successfully.", nil, nil),
+		dropped:  prometheus.NewDesc("analytics_messages_dropped_total", "Messages dropped without being uploaded.", nil, nil),
+		retried:  prometheus.NewDesc("analytics_retries_total", "Upload attempts made after a failure.", nil, nil),
+		queued:   prometheus.NewDesc("analytics_queue_length", "Messages waiting to be uploaded.", nil, nil),
+		inFlight: prometheus.NewDesc("analytics_messages_in_flight", "Messages being uploaded.", nil, nil),
+		latency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "analytics_flush_duration_seconds",
+			Help:    "Time taken to upload a batch, retries included.",
+			Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+		}),
+	}
+
+	trace := client.TraceBatch
+	client.TraceBatch = func(ctx context.Context, n, size int) (context.Context, func(int, error)) {
+		start := time.Now()
+		end := func(int, error) {}
+		if trace != nil {
+			ctx, end = trace(ctx, n, size)
+		}
+		return ctx, func(retries int, err error) {
+			c.latency.Observe(time.Since(start).Seconds())
+			end(retries, err)
+		}
+	}
+
+	return c
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.enqueued
+	ch <- c.sent
+	ch <- c.batches
+	ch <- c.dropped
+	ch <- c.retried
+	ch <- c.queued
+	ch <- c.inFlight
+	c.latency.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.client.Stats()
+	ch <- prometheus.MustNewConstMetric(c.enqueued, prometheus.CounterValue, float64(stats.MessagesEnqueued))
+	ch <- prometheus.MustNewConstMetric(c.sent, prometheus.CounterValue, float64(stats.MessagesSent))
+	ch <- prometheus.MustNewConstMetric(c.batches, prometheus.CounterValue, float64(stats.BatchesSent))
+	ch <- prometheus.MustNewConstMetric(c.dropped, prometheus.CounterValue, float64(stats.MessagesDropped))
+	ch <- prometheus.MustNewConstMetric(c.retried, prometheus.CounterValue, float64(stats.RetriesTotal))
+	ch <- prometheus.MustNewConstMetric(c.queued, prometheus.GaugeValue, float64(stats.QueueLength))
+	ch <- prometheus.MustNewConstMetric(c.inFlight, prometheus.GaugeValue, float64(stats.MessagesInFlight))
+	c.latency.Collect(ch)
+}
@@ -0,0 +1,45 @@
+package analyticsprom
+
+import "net/http/httptest"
+import "net/http"
+import "testing"
+
+import "github.com/prometheus/client_golang/prometheus"
+import "github.com/segmentio/analytics-go"
+
+func TestCollector(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	client := analytics.New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Sync = true
+	collector := New(client)
+
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(collector)
+
+	client.Track(&analytics.Track{Event: "Download", UserId: "123456"})
+	client.Track(&analytics.Track{Event: "Download", UserId: "123456"})
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := map[string]float64{}
+	for _, family := range families {
+		m := family.GetMetric()[0]
+		switch {
+		case m.Counter != nil:
+			metrics[family.GetName()] = m.Counter.GetValue()
+		case m.Histogram != nil:
+			metrics[family.GetName()] = float64(m.Histogram.GetSampleCount())
+		}
+	}
+	if metrics["analytics_messages_sent_total"] != 2 || metrics["analytics_messages_enqueued_total"] != 2 {
+		t.Errorf("unexpected counters %v", metrics)
+	}
+	if metrics["analytics_flush_duration_seconds"] != 2 {
+		t.Errorf("expected 2 observed flushes, got %v", metrics["analytics_flush_duration_seconds"])
+	}
+}
@@ -0,0 +1,127 @@
+// Package analyticstest provides an in-memory analytics client and a fake
+// clock for testing code that sends analytics messages.
+package analyticstest
+
+import (
+	"context"
+	"sync"
+
+	"github.com/segmentio/analytics-go"
+)
+
+// Client records the messages enqueued to it instead of uploading them. It
+// validates messages with the same rules as analytics.Client.
+type Client struct {
+	mtx  sync.Mutex
+	msgs []interface{}
+}
+
+var _ analytics.Interface = (*Client)(nil)
+
+// New in-memory client.
+func New() *Client {
+	return &Client{}
+}
+
+// Alias records an "alias" message.
+func (c *Client) Alias(msg *analytics.Alias) error {
+	return c.Enqueue(msg)
+}
+
+// Page records a "page" message.
+func (c *Client) Page(msg *analytics.Page) error {
+	return c.Enqueue(msg)
+}
+
+// Screen records a "screen" message.
+func (c *Client) Screen(msg *analytics.Screen) error {
+	return c.Enqueue(msg)
+}
+
+// Group records a "group" message.
+func (c *Client) Group(msg *analytics.Group) error {
+	return c.Enqueue(msg)
+}
+
+// Identify records an "identify" message.
+func (c *Client) Identify(msg *analytics.Identify) error {
+	return c.Enqueue(msg)
+}
+
+// Track records a "track" message.
+func (c *Client) Track(msg *analytics.Track) error {
+	return c.Enqueue(msg)
+}
+
+// Enqueue records msg if it is valid.
+func (c *Client) Enqueue(msg interface{}) error {
+	return c.EnqueueContext(context.Background(), msg)
+}
+
+// EnqueueContext records msg if it is valid, ctx is ignored.
+func (c *Client) EnqueueContext(ctx context.Context, msg interface{}) error {
+	if err := analytics.Validate(msg); err != nil {
+		return err
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.msgs = append(c.msgs, msg)
+	return nil
+}
+
+// EnqueueAwait records msg if it is valid, returning a channel receiving the
+// error of Enqueue.
+func (c *Client) EnqueueAwait(msg interface{}) <-chan error {
+	result := make(chan error, 1)
+	result <- c.Enqueue(msg)
+	return result
+}
+
+// EnqueueBatch records msgs if all of them are valid.
+func (c *Client) EnqueueBatch(msgs ...interface{}) error {
+	for _, msg := range msgs {
+		if err := analytics.Validate(msg); err != nil {
+			return err
+		}
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.msgs = append(c.msgs, msgs...)
+	return nil
+}
+
+// Flush does nothing.
+func (c *Client) Flush() error {
+	return nil
+}
+
+// FlushContext does nothing.
+func (c *Client) FlushContext(ctx context.Context) error {
+	return nil
+}
+
+// Close does nothing.
+func (c *Client) Close() error {
+	return nil
+}
+
+// Messages returns the messages recorded so far, in the order they were
+// enqueued.
+func (c *Client) Messages() []interface{} {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return append([]interface{}(nil), c.msgs...)
+}
+
+// TrackCalls returns the recorded "track" messages for event.
+func (c *Client) TrackCalls(event string) []*analytics.Track {
+	var tracks []*analytics.Track
+	for _, msg := range c.Messages() {
+		if track, ok := msg.(*analytics.Track); ok && track.Event == event {
+			tracks = append(tracks, track)
+		}
+	}
+	return tracks
+}
@@ -0,0 +1,75 @@
+package analyticstest
+
+import "net/http/httptest"
+import "net/http"
+import "testing"
+import "time"
+
+import "github.com/segmentio/analytics-go"
+
+func TestClient(t *testing.T) {
+	var client analytics.Interface = New()
+
+	client.Track(&analytics.Track{Event: "Download", UserId: "123456"})
+	client.Identify(&analytics.Identify{UserId: "123456"})
+	client.Track(&analytics.Track{Event: "Upload", UserId: "123456"})
+
+	if err := client.Track(&analytics.Track{Event: "Download"}); err == nil {
+		t.Error("expected invalid messages to be rejected")
+	}
+
+	mock := client.(*Client)
+	if n := len(mock.Messages()); n != 3 {
+		t.Errorf("expected 3 messages, got %d", n)
+	}
+	if calls := mock.TrackCalls("Download"); len(calls) != 1 || calls[0].UserId != "123456" {
+		t.Errorf("unexpected Download calls %v", calls)
+	}
+	if err := client.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClock(t *testing.T) {
+	requests := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- struct{}{}
+	}))
+	defer server.Close()
+
+	clock := NewClock(time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC))
+	client := analytics.New("h97jamjwbh")
+	client.Endpoint = server.URL
+	client.Interval = time.Minute
+	client.Clock = clock
+	defer client.Close()
+
+	client.Track(&analytics.Track{Event: "Download", UserId: "123456"})
+	clock.Add(30 * time.Second)
+	select {
+	case <-requests:
+		t.Fatal("expected no upload before the interval")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	clock.Add(30 * time.Second)
+	select {
+	case <-requests:
+	case <-time.After(time.Second):
+		t.Error("expected an upload once the interval passed")
+	}
+}
+
+func TestClockAfterElapsed(t *testing.T) {
+	clock := NewClock(time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC))
+	for _, d := range []time.Duration{0, -time.Second} {
+		select {
+		case now := <-clock.After(d):
+			if !now.Equal(clock.Now()) {
+				t.Errorf("expected the time of the clock, got %v", now)
+			}
+		default:
+			t.Errorf("expected After(%v) to fire right away", d)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package analyticstest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/segmentio/analytics-go"
+)
+
+// Clock is a fake analytics.Clock whose time only moves forward with Add,
+// firing the tickers and timers that are due.
+type Clock struct {
+	mtx    sync.Mutex
+	now    time.Time
+	timers []*timer
+}
+
+var _ analytics.Clock = (*Clock)(nil)
+
+// Timer or ticker of a Clock, which is a ticker if period is set.
+type timer struct {
+	clock  *Clock
+	at     time.Time
+	period time.Duration
+	c      chan time.Time
+}
+
+// NewClock returns a fake clock set to now.
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+// Now returns the time of the clock.
+func (c *Clock) Now() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.now
+}
+
+// NewTicker returns a ticker firing every d of the clock's time.
+func (c *Clock) NewTicker(d time.Duration) analytics.Ticker {
+	return c.add(d, d)
+}
+
+// After returns a channel receiving the time once d of the clock's time has
+// passed, right away if d isn't positive as with time.After.
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	if d <= 0 {
+		ch := make(chan time.Time, 1)
+		ch <- c.Now()
+		return ch
+	}
+	return c.add(d, 0).c
+}
+
+// Add d to the time of the clock. Like time.Ticker, tickers drop the ticks
+// that their reader is too slow for.
+func (c *Clock) Add(d time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.now = c.now.Add(d)
+
+	timers := c.timers[:0]
+	for _, t := range c.timers {
+		for !t.at.After(c.now) {
+			select {
+			case t.c <- t.at:
+			default:
+			}
+			if t.period == 0 {
+				break
+			}
+			t.at = t.at.Add(t.period)
+		}
+		if t.at.After(c.now) {
+			timers = append(timers, t)
+		}
+	}
+	c.timers = timers
+}
+
+// Register a timer due in d.
+func (c *Clock) add(d, period time.Duration) *timer {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	t := &timer{clock: c, at: c.now.Add(d), period: period, c: make(chan time.Time, 1)}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (t *timer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *timer) Stop() {
+	t.clock.mtx.Lock()
+	defer t.clock.mtx.Unlock()
+	for i, u := range t.clock.timers {
+		if u == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return
+		}
+	}
+}
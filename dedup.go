@@ -0,0 +1,48 @@
+package analytics
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Number of message ids remembered to detect duplicates.
+const dedupSize = 10000
+
+// Bounded set of the most recently seen message ids. The zero value is ready
+// to use.
+type recentIds struct {
+	mtx  sync.Mutex
+	list *list.List
+	ids  map[string]*list.Element
+}
+
+// Record id, reporting whether it was seen recently.
+func (r *recentIds) seen(id string) bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.ids == nil {
+		r.list = list.New()
+		r.ids = make(map[string]*list.Element)
+	}
+
+	if e, ok := r.ids[id]; ok {
+		r.list.MoveToFront(e)
+		return true
+	}
+
+	r.ids[id] = r.list.PushFront(id)
+	if r.list.Len() > dedupSize {
+		oldest := r.list.Back()
+		r.list.Remove(oldest)
+		delete(r.ids, oldest.Value.(string))
+	}
+	return false
+}
+
+// Forget the ids seen so far.
+func (r *recentIds) reset() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.list, r.ids = nil, nil
+}
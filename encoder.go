@@ -0,0 +1,19 @@
+package analytics
+
+import "io"
+
+// Encoder serializes batch requests in a format of its own, such as protobuf,
+// for collectors expecting one, see Client.Encoder. It returns the content
+// type of the request.
+type Encoder interface {
+	Encode(w io.Writer, batch Batch) (contentType string, err error)
+}
+
+// JSONEncoder is the Encoder of the Segment API, which the client uses by
+// default. It can be wrapped by other encoders, e.g. to add a framing.
+type JSONEncoder struct{}
+
+// Encode batch as JSON.
+func (JSONEncoder) Encode(w io.Writer, batch Batch) (string, error) {
+	return EncodingJSON.contentType(), writeBatch(w, &batch)
+}
@@ -0,0 +1,113 @@
+package analytics
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// NewFromEnv returns a client configured from the environment:
+//
+//	SEGMENT_WRITE_KEY       the write key, required
+//	SEGMENT_ENDPOINT        Endpoint
+//	SEGMENT_BATCH_SIZE      Size, a positive integer
+//	SEGMENT_FLUSH_INTERVAL  Interval, a positive duration such as "10s"
+//	SEGMENT_MAX_QUEUE_SIZE  MaxQueueSize, a positive integer
+//	SEGMENT_MAX_RETRIES     MaxRetries, a positive integer
+//	SEGMENT_SAMPLE_RATE     SampleRate, a fraction between 0 and 1
+//	SEGMENT_GZIP            Gzip, a boolean such as "true" or "0"
+//	SEGMENT_VERBOSE         Verbose, a boolean
+//
+// Unset or empty variables keep the defaults of New. A *ConfigError is
+// returned for a missing or malformed write key, see ValidateWriteKey, or a
+// malformed value.
+func NewFromEnv() (*Client, error) {
+	key := os.Getenv("SEGMENT_WRITE_KEY")
+	if key == "" {
+		return nil, &ConfigError{Err: errors.New("SEGMENT_WRITE_KEY is not set")}
+	}
+	if err := ValidateWriteKey(key); err != nil {
+		return nil, &ConfigError{Err: fmt.Errorf("invalid SEGMENT_WRITE_KEY: %s", err)}
+	}
+
+	client := New(key)
+	if endpoint := os.Getenv("SEGMENT_ENDPOINT"); endpoint != "" {
+		client.Endpoint = endpoint
+	}
+	err := firstError(
+		envInt("SEGMENT_BATCH_SIZE", &client.Size),
+		envDuration("SEGMENT_FLUSH_INTERVAL", &client.Interval),
+		envInt("SEGMENT_MAX_QUEUE_SIZE", &client.MaxQueueSize),
+		envInt("SEGMENT_MAX_RETRIES", &client.MaxRetries),
+		envFloat("SEGMENT_SAMPLE_RATE", &client.SampleRate),
+		envBool("SEGMENT_GZIP", &client.Gzip),
+		envBool("SEGMENT_VERBOSE", &client.Verbose),
+	)
+	if err != nil {
+		return nil, &ConfigError{Err: err}
+	}
+	return client, nil
+}
+
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func envInt(name string, v *int) error {
+	s := os.Getenv(name)
+	if s == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return fmt.Errorf("invalid %s %q: expected a positive integer", name, s)
+	}
+	*v = n
+	return nil
+}
+
+func envDuration(name string, v *time.Duration) error {
+	s := os.Getenv(name)
+	if s == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("invalid %s %q: expected a positive duration", name, s)
+	}
+	*v = d
+	return nil
+}
+
+func envFloat(name string, v *float64) error {
+	s := os.Getenv(name)
+	if s == "" {
+		return nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f < 0 || f > 1 {
+		return fmt.Errorf("invalid %s %q: expected a fraction between 0 and 1", name, s)
+	}
+	*v = f
+	return nil
+}
+
+func envBool(name string, v *bool) error {
+	s := os.Getenv(name)
+	if s == "" {
+		return nil
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: expected a boolean", name, s)
+	}
+	*v = b
+	return nil
+}
@@ -0,0 +1,142 @@
+// Package filestore persists the queue of an analytics.Client in a
+// directory, with one file per message.
+package filestore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/segmentio/analytics-go"
+)
+
+// Store of messages in a directory. It must not be shared by processes.
+type Store struct {
+	dir string
+
+	mtx sync.Mutex
+	seq uint64
+	// taken are the ids returned by Put or Get, which are not returned again.
+	taken map[string]bool
+}
+
+var _ analytics.Store = (*Store)(nil)
+
+// Open the store in dir, creating it if needed. The messages found there are
+// returned by Get.
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	s := &Store{dir: dir, taken: make(map[string]bool)}
+	ids, err := s.ids()
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) > 0 {
+		last, _ := strconv.ParseUint(ids[len(ids)-1], 10, 64)
+		s.seq = last + 1
+	}
+	return s, nil
+}
+
+// Put writes msg to a new file. The file is renamed into place once written
+// so that a crash never leaves a partial message behind.
+func (s *Store) Put(msg []byte) (string, error) {
+	s.mtx.Lock()
+	id := fmt.Sprintf("%020d", s.seq)
+	s.seq++
+	s.taken[id] = true
+	s.mtx.Unlock()
+
+	tmp := s.path(id) + ".tmp"
+	if err := ioutil.WriteFile(tmp, msg, 0600); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, s.path(id)); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return id, nil
+}
+
+// Get reads up to n messages that are not taken, oldest first.
+func (s *Store) Get(n int) ([]analytics.StoredMessage, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	ids, err := s.ids()
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []analytics.StoredMessage
+	for _, id := range ids {
+		if len(msgs) == n {
+			break
+		}
+		if s.taken[id] {
+			continue
+		}
+		b, err := ioutil.ReadFile(s.path(id))
+		if err != nil {
+			return nil, err
+		}
+		s.taken[id] = true
+		msgs = append(msgs, analytics.StoredMessage{Id: id, Data: b})
+	}
+	return msgs, nil
+}
+
+// Ack removes the files of the messages.
+func (s *Store) Ack(ids ...string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, id := range ids {
+		if err := os.Remove(s.path(id)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		delete(s.taken, id)
+	}
+	return nil
+}
+
+// Nack releases the messages.
+func (s *Store) Nack(ids ...string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, id := range ids {
+		delete(s.taken, id)
+	}
+	return nil
+}
+
+// Return the ids of the messages in the directory, in order.
+func (s *Store) ids() ([]string, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, file := range files {
+		if id := strings.TrimSuffix(file.Name(), ".json"); id != file.Name() {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// Return the path of the message file.
+func (s *Store) path(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
@@ -0,0 +1,51 @@
+package filestore
+
+import "io/ioutil"
+import "os"
+import "testing"
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filestore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := store.Put([]byte(`{"event":"first"}`))
+	second, _ := store.Put([]byte(`{"event":"second"}`))
+	store.Put([]byte(`{"event":"third"}`))
+
+	if msgs, _ := store.Get(10); len(msgs) != 0 {
+		t.Errorf("expected the messages put to be taken, got %v", msgs)
+	}
+	store.Ack(first)
+	store.Nack(second)
+	if msgs, _ := store.Get(10); len(msgs) != 1 || string(msgs[0].Data) != `{"event":"second"}` {
+		t.Errorf("expected the nacked message, got %v", msgs)
+	}
+
+	// reopening the store, as after a restart.
+	store, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := store.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].Id != second {
+		t.Errorf("expected the oldest message left, got %v", msgs)
+	}
+	if msgs, _ := store.Get(10); len(msgs) != 1 || string(msgs[0].Data) != `{"event":"third"}` {
+		t.Errorf("expected the last message left, got %v", msgs)
+	}
+
+	id, _ := store.Put([]byte(`{"event":"fourth"}`))
+	if id <= msgs[0].Id {
+		t.Errorf("expected new ids to follow the stored ones, got %s", id)
+	}
+}
@@ -0,0 +1,179 @@
+package analytics
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Encoding of the batch requests.
+type Encoding int
+
+const (
+	// EncodingJSON is the encoding of the Segment API.
+	EncodingJSON Encoding = iota
+	// EncodingMsgpack is msgpack with the field names of the JSON encoding,
+	// for compatible collectors that accept it.
+	EncodingMsgpack
+)
+
+// Return the content type of the encoding.
+func (e Encoding) contentType() string {
+	if e == EncodingMsgpack {
+		return "application/msgpack"
+	}
+	return "application/json"
+}
+
+// Return batch encoded with e, renaming its fields and those of its messages
+// by mapping. Msgpack and renaming go through JSON so that the json tags and
+// marshalers of the messages are respected.
+func (e Encoding) marshal(batch *Batch, mapping map[string]string) ([]byte, error) {
+	b, err := json.Marshal(batch)
+	if err != nil || (e != EncodingMsgpack && len(mapping) == 0) {
+		return b, err
+	}
+
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var w map[string]interface{}
+	if err := d.Decode(&w); err != nil {
+		return nil, err
+	}
+
+	if len(mapping) > 0 {
+		if msgs, ok := w["batch"].([]interface{}); ok {
+			for _, msg := range msgs {
+				if msg, ok := msg.(map[string]interface{}); ok {
+					renameFields(msg, mapping)
+				}
+			}
+		}
+		renameFields(w, mapping)
+	}
+
+	if e == EncodingMsgpack {
+		return appendMsgpack(nil, w)
+	}
+	return json.Marshal(w)
+}
+
+// Rename the keys of m by mapping.
+func renameFields(m map[string]interface{}, mapping map[string]string) {
+	renamed := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		if name, ok := mapping[k]; ok {
+			k = name
+		}
+		renamed[k] = v
+	}
+	for k := range m {
+		delete(m, k)
+	}
+	for k, v := range renamed {
+		m[k] = v
+	}
+}
+
+// Append the msgpack encoding of v, a value decoded from JSON, to b. Map
+// keys are sorted so that the output is deterministic.
+func appendMsgpack(b []byte, v interface{}) ([]byte, error) {
+	var err error
+
+	switch v := v.(type) {
+	case nil:
+		return append(b, 0xc0), nil
+
+	case bool:
+		if v {
+			return append(b, 0xc3), nil
+		}
+		return append(b, 0xc2), nil
+
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return appendMsgpackInt(b, i), nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, 0xcb)
+		return appendUint(b, math.Float64bits(f), 8), nil
+
+	case string:
+		b = appendMsgpackHeader(b, len(v), 0xa0, 32, 0xd9, 0xda, 0xdb)
+		return append(b, v...), nil
+
+	case []interface{}:
+		b = appendMsgpackHeader(b, len(v), 0x90, 16, 0, 0xdc, 0xdd)
+		for _, e := range v {
+			if b, err = appendMsgpack(b, e); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		b = appendMsgpackHeader(b, len(v), 0x80, 16, 0, 0xde, 0xdf)
+		for _, k := range keys {
+			b, _ = appendMsgpack(b, k)
+			if b, err = appendMsgpack(b, v[k]); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+
+	return nil, fmt.Errorf("unsupported msgpack value %T", v)
+}
+
+// Append the header of a string, array or map of n elements, using the fix
+// format below fixmax and the 8, 16 or 32 bits formats otherwise. Formats
+// which don't exist are 0.
+func appendMsgpackHeader(b []byte, n int, fix byte, fixmax int, f8, f16, f32 byte) []byte {
+	switch {
+	case n < fixmax:
+		return append(b, fix|byte(n))
+	case n <= math.MaxUint8 && f8 != 0:
+		return append(b, f8, byte(n))
+	case n <= math.MaxUint16:
+		return appendUint(append(b, f16), uint64(n), 2)
+	default:
+		return appendUint(append(b, f32), uint64(n), 4)
+	}
+}
+
+// Append the smallest msgpack encoding of integer i.
+func appendMsgpackInt(b []byte, i int64) []byte {
+	switch {
+	case i >= 0 && i < 128:
+		return append(b, byte(i))
+	case i < 0 && i >= -32:
+		return append(b, byte(int8(i)))
+	case i >= math.MinInt8 && i <= math.MaxInt8:
+		return append(b, 0xd0, byte(int8(i)))
+	case i >= math.MinInt16 && i <= math.MaxInt16:
+		return appendUint(append(b, 0xd1), uint64(i), 2)
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		return appendUint(append(b, 0xd2), uint64(i), 4)
+	default:
+		return appendUint(append(b, 0xd3), uint64(i), 8)
+	}
+}
+
+// Append the n low bytes of v to b, big endian.
+func appendUint(b []byte, v uint64, n int) []byte {
+	for i := n - 1; i >= 0; i-- {
+		b = append(b, byte(v>>(8*uint(i))))
+	}
+	return b
+}
@@ -0,0 +1,191 @@
+package analytics
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Multi enqueues every message to several clients, e.g. to write to both an
+// old and a new collector during a migration. Every client gets its own copy
+// of the messages, which they complete separately.
+type Multi struct {
+	Clients []Interface
+	// FailOnAny makes enqueueing fail as soon as one of the clients fails,
+	// rather than only when all of them do.
+	FailOnAny bool
+}
+
+var _ Interface = (*Multi)(nil)
+
+// MultiClient returns a client enqueueing the messages to all of clients.
+func MultiClient(clients ...Interface) *Multi {
+	return &Multi{Clients: clients}
+}
+
+// Alias enqueues an "alias" message to the clients.
+func (m *Multi) Alias(msg *Alias) error {
+	return m.Enqueue(msg)
+}
+
+// Page enqueues a "page" message to the clients.
+func (m *Multi) Page(msg *Page) error {
+	return m.Enqueue(msg)
+}
+
+// Screen enqueues a "screen" message to the clients.
+func (m *Multi) Screen(msg *Screen) error {
+	return m.Enqueue(msg)
+}
+
+// Group enqueues a "group" message to the clients.
+func (m *Multi) Group(msg *Group) error {
+	return m.Enqueue(msg)
+}
+
+// Identify enqueues an "identify" message to the clients.
+func (m *Multi) Identify(msg *Identify) error {
+	return m.Enqueue(msg)
+}
+
+// Track enqueues a "track" message to the clients.
+func (m *Multi) Track(msg *Track) error {
+	return m.Enqueue(msg)
+}
+
+// Enqueue msg to the clients.
+func (m *Multi) Enqueue(msg interface{}) error {
+	return m.EnqueueContext(context.Background(), msg)
+}
+
+// EnqueueContext enqueues msg to the clients, returning their errors if all
+// of them failed, or if any did with FailOnAny.
+func (m *Multi) EnqueueContext(ctx context.Context, msg interface{}) error {
+	msgs := m.copies(msg)
+	errs := make([]error, len(m.Clients))
+	for i, client := range m.Clients {
+		errs[i] = client.EnqueueContext(ctx, msgs[i])
+	}
+	return m.enqueueError(errs)
+}
+
+// EnqueueAwait enqueues msg to the clients, returning a channel receiving
+// their errors once all of them know the outcome of the message, following
+// the same rules as EnqueueContext.
+func (m *Multi) EnqueueAwait(msg interface{}) <-chan error {
+	msgs := m.copies(msg)
+	results := make([]<-chan error, len(m.Clients))
+	for i, client := range m.Clients {
+		results[i] = client.EnqueueAwait(msgs[i])
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		errs := make([]error, len(results))
+		for i, r := range results {
+			errs[i] = <-r
+		}
+		result <- m.enqueueError(errs)
+	}()
+	return result
+}
+
+// EnqueueBatch enqueues msgs to the clients, following the same rules as
+// EnqueueContext.
+func (m *Multi) EnqueueBatch(msgs ...interface{}) error {
+	copies := make([][]interface{}, len(m.Clients))
+	for i := range copies {
+		copies[i] = make([]interface{}, len(msgs))
+	}
+	for j, msg := range msgs {
+		for i, c := range m.copies(msg) {
+			copies[i][j] = c
+		}
+	}
+
+	errs := make([]error, len(m.Clients))
+	for i, client := range m.Clients {
+		errs[i] = client.EnqueueBatch(copies[i]...)
+	}
+	return m.enqueueError(errs)
+}
+
+// Flush the clients concurrently, returning their errors.
+func (m *Multi) Flush() error {
+	return m.each(func(client Interface) error { return client.Flush() })
+}
+
+// FlushContext flushes the clients concurrently, returning their errors.
+func (m *Multi) FlushContext(ctx context.Context) error {
+	return m.each(func(client Interface) error { return client.FlushContext(ctx) })
+}
+
+// Close the clients concurrently, returning their errors.
+func (m *Multi) Close() error {
+	return m.each(func(client Interface) error { return client.Close() })
+}
+
+// Return a copy of msg for every client, as they complete the messages they
+// are given. The maps of the messages are shared: clients replace them
+// rather than modify them.
+func (m *Multi) copies(msg interface{}) []interface{} {
+	msgs := make([]interface{}, len(m.Clients))
+	for i := range msgs {
+		if i == 0 {
+			msgs[i] = msg
+			continue
+		}
+		switch v := msg.(type) {
+		case *Alias:
+			c := *v
+			msgs[i] = &c
+		case *Page:
+			c := *v
+			msgs[i] = &c
+		case *Screen:
+			c := *v
+			msgs[i] = &c
+		case *Group:
+			c := *v
+			msgs[i] = &c
+		case *Identify:
+			c := *v
+			msgs[i] = &c
+		case *Track:
+			c := *v
+			msgs[i] = &c
+		default:
+			msgs[i] = msg
+		}
+	}
+	return msgs
+}
+
+// Return the errors of the clients if enqueueing failed.
+func (m *Multi) enqueueError(errs []error) error {
+	failed := 0
+	for _, err := range errs {
+		if err != nil {
+			failed++
+		}
+	}
+	if failed == 0 || (!m.FailOnAny && failed < len(errs)) {
+		return nil
+	}
+	return errors.Join(errs...)
+}
+
+// Call f for every client concurrently, returning their errors.
+func (m *Multi) each(f func(client Interface) error) error {
+	errs := make([]error, len(m.Clients))
+	var wg sync.WaitGroup
+	for i, client := range m.Clients {
+		wg.Add(1)
+		go func(i int, client Interface) {
+			defer wg.Done()
+			errs[i] = f(client)
+		}(i, client)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
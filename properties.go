@@ -0,0 +1,62 @@
+package analytics
+
+// Properties of track and page messages. The setters return the properties
+// so they can be chained, and since the underlying type is a map they can be
+// assigned to the Properties fields directly.
+type Properties map[string]interface{}
+
+// NewProperties returns empty properties.
+func NewProperties() Properties {
+	return make(Properties, 10)
+}
+
+// Set the property name to value.
+func (p Properties) Set(name string, value interface{}) Properties {
+	p[name] = value
+	return p
+}
+
+// SetRevenue sets the "revenue" property.
+func (p Properties) SetRevenue(revenue float64) Properties {
+	return p.Set("revenue", revenue)
+}
+
+// SetCurrency sets the "currency" property, as an ISO 4217 code.
+func (p Properties) SetCurrency(currency string) Properties {
+	return p.Set("currency", currency)
+}
+
+// SetValue sets the "value" property.
+func (p Properties) SetValue(value float64) Properties {
+	return p.Set("value", value)
+}
+
+// SetName sets the "name" property.
+func (p Properties) SetName(name string) Properties {
+	return p.Set("name", name)
+}
+
+// SetCategory sets the "category" property.
+func (p Properties) SetCategory(category string) Properties {
+	return p.Set("category", category)
+}
+
+// SetPath sets the "path" property of a page.
+func (p Properties) SetPath(path string) Properties {
+	return p.Set("path", path)
+}
+
+// SetReferrer sets the "referrer" property of a page.
+func (p Properties) SetReferrer(referrer string) Properties {
+	return p.Set("referrer", referrer)
+}
+
+// SetTitle sets the "title" property of a page.
+func (p Properties) SetTitle(title string) Properties {
+	return p.Set("title", title)
+}
+
+// SetURL sets the "url" property of a page.
+func (p Properties) SetURL(url string) Properties {
+	return p.Set("url", url)
+}
@@ -0,0 +1,56 @@
+package analytics
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Token bucket holding up to a second worth of requests. The zero value is
+// ready to use.
+type limiter struct {
+	mtx    sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// Wait for a token at the given rate per second, or until ctx is done.
+func (l *limiter) wait(ctx context.Context, rate float64) error {
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+
+	l.mtx.Lock()
+	now := time.Now()
+	if l.last.IsZero() {
+		l.tokens = burst
+	} else if l.tokens += now.Sub(l.last).Seconds() * rate; l.tokens > burst {
+		l.tokens = burst
+	}
+	l.last = now
+	// Take the token right away, waiting for it to be refilled if it went
+	// into debt, so that concurrent waiters are queued behind each other.
+	l.tokens--
+	delay := time.Duration(-l.tokens / rate * float64(time.Second))
+	l.mtx.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// give the token back, so that it isn't lost to later waiters.
+		l.mtx.Lock()
+		if l.tokens++; l.tokens > burst {
+			l.tokens = burst
+		}
+		l.mtx.Unlock()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,183 @@
+package analytics
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// Body of a batch request. JSON batches without a FieldMapping are streamed:
+// encoded one message at a time into every request, rather than held in
+// memory once serialized. Other batches are marshalled up front.
+type batchBody struct {
+	// batch is streamed when b, its serialization, is nil.
+	batch *Batch
+	b     []byte
+	// size is the serialized size of the batch, before compression.
+	size    int
+	gzipped bool
+	// compressed is the size of the last body streamed compressed.
+	compressed int64
+	// contentType is that of a batch serialized by an Encoder, if any.
+	contentType string
+	// idempotencyKey is sent with the requests when set, see Idempotent.
+	idempotencyKey string
+	// results are those of the response, with PartialFailureSupport.
+	results []partialResult
+	// wg tracks the goroutines streaming the batch.
+	wg sync.WaitGroup
+}
+
+// Return the body of batch, checking that it can be serialized.
+func (c *Client) newBatchBody(batch *Batch) (*batchBody, error) {
+	if c.Encoder != nil {
+		var b bytes.Buffer
+		var contentType string
+		var err error
+		if c.protect(func() { contentType, err = c.Encoder.Encode(&b, *batch) }) {
+			err = errors.New("encoder panicked")
+		}
+		return &batchBody{batch: batch, b: b.Bytes(), size: b.Len(), contentType: contentType}, err
+	}
+	if c.Encoding != EncodingJSON || len(c.FieldMapping) > 0 {
+		b, err := c.Encoding.marshal(batch, c.FieldMapping)
+		return &batchBody{batch: batch, b: b, size: len(b)}, err
+	}
+
+	var n countingWriter
+	if err := writeBatch(&n, batch); err != nil {
+		return nil, err
+	}
+	return &batchBody{batch: batch, size: n.n}, nil
+}
+
+// Compress the body with gzip, right away if it is marshalled or as it is
+// streamed otherwise.
+func (b *batchBody) compress() error {
+	if b.b != nil {
+		z, err := compress(b.b)
+		if err != nil {
+			return err
+		}
+		b.b = z
+	}
+	b.gzipped = true
+	return nil
+}
+
+// Open a reader of the body, encoding the batch again if it is streamed.
+func (b *batchBody) open() (io.ReadCloser, error) {
+	if b.b != nil {
+		return ioutil.NopCloser(bytes.NewReader(b.b)), nil
+	}
+
+	r, w := io.Pipe()
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		if !b.gzipped {
+			w.CloseWithError(writeBatch(w, b.batch))
+			return
+		}
+		n := &countingWriter{w: w}
+		z := gzip.NewWriter(n)
+		err := writeBatch(z, b.batch)
+		if err == nil {
+			err = z.Close()
+		}
+		atomic.StoreInt64(&b.compressed, int64(n.n))
+		w.CloseWithError(err)
+	}()
+	return r, nil
+}
+
+// Set the body of req. Its length is unknown when streamed compressed.
+func (b *batchBody) attach(req *http.Request) error {
+	body, err := b.open()
+	if err != nil {
+		return err
+	}
+	req.Body, req.GetBody = body, b.open
+	switch {
+	case b.b != nil:
+		req.ContentLength = int64(len(b.b))
+	case !b.gzipped:
+		req.ContentLength = int64(b.size)
+	default:
+		req.ContentLength = -1
+	}
+	return nil
+}
+
+// Return the size of the body once compressed. When streamed, it is known
+// once the request was sent, and wait returned.
+func (b *batchBody) compressedSize() int64 {
+	if b.b != nil {
+		return int64(len(b.b))
+	}
+	return atomic.LoadInt64(&b.compressed)
+}
+
+// Wait for the streaming of the bodies opened so far to stop, once they
+// were closed, so that the batch isn't read concurrently with callbacks.
+func (b *batchBody) wait() {
+	b.wg.Wait()
+}
+
+// Write batch as JSON, encoding its messages one at a time.
+func writeBatch(w io.Writer, batch *Batch) error {
+	header, err := json.Marshal(&batch.Message)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	bw.WriteString("{")
+	if len(batch.Context) > 0 {
+		bw.WriteString(`"context":`)
+		if err := enc.Encode(batch.Context); err != nil {
+			return err
+		}
+		bw.WriteString(",")
+	}
+	bw.WriteString(`"batch":[`)
+	for i, msg := range batch.Messages {
+		if i > 0 {
+			bw.WriteString(",")
+		}
+		if err := enc.Encode(msg); err != nil {
+			return err
+		}
+	}
+	bw.WriteString("]")
+	if len(header) > 2 {
+		bw.WriteString(",")
+		bw.Write(header[1 : len(header)-1])
+	}
+	bw.WriteString("}")
+	return bw.Flush()
+}
+
+// Writer counting the bytes written to w, which are discarded if it is nil.
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	if w.w == nil {
+		w.n += len(b)
+		return len(b), nil
+	}
+	n, err := w.w.Write(b)
+	w.n += n
+	return n, err
+}
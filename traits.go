@@ -0,0 +1,74 @@
+package analytics
+
+import "time"
+
+// Traits of identify and group messages. The setters return the traits so
+// they can be chained, and since the underlying type is a map they can be
+// assigned to the Traits fields directly.
+type Traits map[string]interface{}
+
+// NewTraits returns empty traits.
+func NewTraits() Traits {
+	return make(Traits, 10)
+}
+
+// Set the trait name to value.
+func (t Traits) Set(name string, value interface{}) Traits {
+	t[name] = value
+	return t
+}
+
+// SetAddress sets the "address" trait.
+func (t Traits) SetAddress(address map[string]interface{}) Traits {
+	return t.Set("address", address)
+}
+
+// SetAvatar sets the "avatar" trait, the URL of an image.
+func (t Traits) SetAvatar(url string) Traits {
+	return t.Set("avatar", url)
+}
+
+// SetCreatedAt sets the "createdAt" trait.
+func (t Traits) SetCreatedAt(createdAt time.Time) Traits {
+	return t.Set("createdAt", timestamp(createdAt))
+}
+
+// SetDescription sets the "description" trait.
+func (t Traits) SetDescription(description string) Traits {
+	return t.Set("description", description)
+}
+
+// SetEmail sets the "email" trait.
+func (t Traits) SetEmail(email string) Traits {
+	return t.Set("email", email)
+}
+
+// SetFirstName sets the "firstName" trait.
+func (t Traits) SetFirstName(firstName string) Traits {
+	return t.Set("firstName", firstName)
+}
+
+// SetLastName sets the "lastName" trait.
+func (t Traits) SetLastName(lastName string) Traits {
+	return t.Set("lastName", lastName)
+}
+
+// SetName sets the "name" trait.
+func (t Traits) SetName(name string) Traits {
+	return t.Set("name", name)
+}
+
+// SetPhone sets the "phone" trait.
+func (t Traits) SetPhone(phone string) Traits {
+	return t.Set("phone", phone)
+}
+
+// SetUsername sets the "username" trait.
+func (t Traits) SetUsername(username string) Traits {
+	return t.Set("username", username)
+}
+
+// SetWebsite sets the "website" trait.
+func (t Traits) SetWebsite(url string) Traits {
+	return t.Set("website", url)
+}